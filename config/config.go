@@ -0,0 +1,377 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+// Package config loads the application configuration from defaults, a YAML or TOML file,
+// environment variables and command line flags, in increasing order of precedence.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EnvDev        = "dev"
+	EnvProduction = "production"
+	// DefaultSigningSecret is only accepted in dev mode
+	DefaultSigningSecret = "supersecret"
+	// MinSigningSecretLength is the minimum length of the signing secret in production, 256 bits for HS256
+	MinSigningSecretLength = 32
+)
+
+// Config is the application configuration
+type Config struct {
+	// Environment is dev or production, production refuses insecure settings
+	Environment string          `yaml:"environment" toml:"environment"`
+	Server      ServerConfig    `yaml:"server" toml:"server"`
+	Proxy       ProxyConfig     `yaml:"proxy" toml:"proxy"`
+	JWT         JWTConfig       `yaml:"jwt" toml:"jwt"`
+	Books       BooksConfig     `yaml:"books" toml:"books"`
+	Users       UsersConfig     `yaml:"users" toml:"users"`
+	APIKeys     APIKeysConfig   `yaml:"apiKeys" toml:"apiKeys"`
+	RBAC        RBACConfig      `yaml:"rbac" toml:"rbac"`
+	Admin       AdminConfig     `yaml:"admin" toml:"admin"`
+	OIDC        OIDCConfig      `yaml:"oidc" toml:"oidc"`
+	Login       LoginConfig     `yaml:"login" toml:"login"`
+	RateLimit   RateLimitConfig `yaml:"rateLimit" toml:"rateLimit"`
+}
+
+type ServerConfig struct {
+	Port int `yaml:"port" toml:"port"`
+}
+
+// ProxyConfig describes the reverse proxy in front of the server. It applies wherever the client address is used:
+// the allowed addresses of the admin routes, login throttling and rate limiting.
+type ProxyConfig struct {
+	// TrustHeaders takes the client address from X-Forwarded-For and X-Real-IP,
+	// only enable it behind a proxy that overwrites them
+	TrustHeaders bool `yaml:"trustHeaders" toml:"trustHeaders"`
+}
+
+// JWTConfig configures how tokens are signed and verified.
+// Tokens are signed with the newest key of KeysDir, the key in PrivateKeyFile, or the HMAC SigningSecret.
+type JWTConfig struct {
+	SigningSecret     string        `yaml:"signingSecret" toml:"signingSecret"`
+	SigningSecretFile string        `yaml:"signingSecretFile" toml:"signingSecretFile"`
+	PrivateKeyFile    string        `yaml:"privateKeyFile" toml:"privateKeyFile"`
+	KeyID             string        `yaml:"keyId" toml:"keyId"`
+	KeysDir           string        `yaml:"keysDir" toml:"keysDir"`
+	KeysWatchInterval time.Duration `yaml:"keysWatchInterval" toml:"keysWatchInterval"`
+	Issuer            string        `yaml:"issuer" toml:"issuer"`
+	Audience          string        `yaml:"audience" toml:"audience"`
+	AccessTokenTTL    time.Duration `yaml:"accessTokenTTL" toml:"accessTokenTTL"`
+	RefreshTokenTTL   time.Duration `yaml:"refreshTokenTTL" toml:"refreshTokenTTL"`
+}
+
+type BooksConfig struct {
+	// Storage is memory, sqlite or file
+	Storage string `yaml:"storage" toml:"storage"`
+	// SeedFile holds the demo dataset loaded into an empty storage
+	SeedFile string `yaml:"seedFile" toml:"seedFile"`
+	// File is the JSON file of the file storage, SeedFile when empty
+	File         string        `yaml:"file" toml:"file"`
+	FileDebounce time.Duration `yaml:"fileDebounce" toml:"fileDebounce"`
+	FileFsync    bool          `yaml:"fileFsync" toml:"fileFsync"`
+	SQLitePath   string        `yaml:"sqlitePath" toml:"sqlitePath"`
+}
+
+type UsersConfig struct {
+	// Storage is memory or file
+	Storage string `yaml:"storage" toml:"storage"`
+	File    string `yaml:"file" toml:"file"`
+}
+
+type APIKeysConfig struct {
+	// Storage is memory or file
+	Storage string `yaml:"storage" toml:"storage"`
+	File    string `yaml:"file" toml:"file"`
+}
+
+type RBACConfig struct {
+	// PolicyFile maps roles to their permissions
+	PolicyFile string `yaml:"policyFile" toml:"policyFile"`
+}
+
+// AdminConfig restricts the tokens accepted by the admin routes
+type AdminConfig struct {
+	// MaxTokenAge is the maximum time since the login a token was issued by, refreshing does not renew it. 0 disables the check
+	MaxTokenAge time.Duration `yaml:"maxTokenAge" toml:"maxTokenAge"`
+	// RequireMFA rejects tokens whose `amr` claim lacks `mfa`, i.e. logins without a TOTP or recovery code
+	RequireMFA bool `yaml:"requireMFA" toml:"requireMFA"`
+	// AllowedIPs are the addresses or CIDR ranges allowed to call admin routes, any when empty
+	AllowedIPs []string `yaml:"allowedIPs" toml:"allowedIPs"`
+}
+
+// LoginConfig throttles failed logins, per username and per client address.
+// Failures beyond the free attempts are delayed exponentially, reaching the max attempts locks the key out.
+type LoginConfig struct {
+	FreeAttempts   int `yaml:"freeAttempts" toml:"freeAttempts"`
+	MaxAttempts    int `yaml:"maxAttempts" toml:"maxAttempts"`
+	IPFreeAttempts int `yaml:"ipFreeAttempts" toml:"ipFreeAttempts"`
+	IPMaxAttempts  int `yaml:"ipMaxAttempts" toml:"ipMaxAttempts"`
+	// BackoffBase is the delay after the first failure beyond the free attempts, doubled on every further failure
+	BackoffBase     time.Duration `yaml:"backoffBase" toml:"backoffBase"`
+	LockoutDuration time.Duration `yaml:"lockoutDuration" toml:"lockoutDuration"`
+	// Window is how long failures are remembered after the last one
+	Window time.Duration `yaml:"window" toml:"window"`
+}
+
+// RateLimitConfig limits the requests of each client per group of routes, as <requests>/<period> such as 100/1m.
+// Clients are identified by their API key, the subject of their JWT, or else their address. Empty or off disables the limit.
+type RateLimitConfig struct {
+	Auth  string `yaml:"auth" toml:"auth"`
+	Books string `yaml:"books" toml:"books"`
+	Core  string `yaml:"core" toml:"core"`
+	Admin string `yaml:"admin" toml:"admin"`
+}
+
+// OIDCConfig delegates logins to an OpenID Connect provider, it is disabled when Issuer is empty
+type OIDCConfig struct {
+	// Issuer is the URL of the provider, its discovery document is served under /.well-known/openid-configuration
+	Issuer       string   `yaml:"issuer" toml:"issuer"`
+	ClientID     string   `yaml:"clientId" toml:"clientId"`
+	ClientSecret string   `yaml:"clientSecret" toml:"clientSecret"`
+	RedirectURL  string   `yaml:"redirectURL" toml:"redirectURL"`
+	Scopes       []string `yaml:"scopes" toml:"scopes"`
+	// RoleClaim is the ID token claim, a string or a list of strings such as groups, mapped to a local role
+	RoleClaim string `yaml:"roleClaim" toml:"roleClaim"`
+	// RoleMappings are <claim value>=<role> rules, the first rule matching a value of RoleClaim wins
+	RoleMappings []string `yaml:"roleMappings" toml:"roleMappings"`
+	// DefaultRole is granted when no rule matches
+	DefaultRole string `yaml:"defaultRole" toml:"defaultRole"`
+}
+
+// Default returns the configuration used when nothing is set
+func Default() *Config {
+	return &Config{
+		Environment: EnvDev,
+		Server:      ServerConfig{Port: 8080},
+		JWT: JWTConfig{
+			KeysWatchInterval: 30 * time.Second,
+			Issuer:            "okapi.jkaninda.dev",
+			Audience:          "okapi.jkaninda.dev",
+			AccessTokenTTL:    15 * time.Minute,
+			RefreshTokenTTL:   7 * 24 * time.Hour,
+		},
+		Books: BooksConfig{
+			Storage:      "memory",
+			SeedFile:     "data/books.json",
+			FileDebounce: time.Second,
+			SQLitePath:   "data/books.db",
+		},
+		Users: UsersConfig{
+			Storage: "memory",
+			File:    "data/users.json",
+		},
+		APIKeys: APIKeysConfig{
+			Storage: "memory",
+			File:    "data/api-keys.json",
+		},
+		RBAC: RBACConfig{
+			PolicyFile: "data/policy.yaml",
+		},
+		Admin: AdminConfig{
+			MaxTokenAge: 10 * time.Minute,
+			RequireMFA:  true,
+		},
+		OIDC: OIDCConfig{
+			Scopes:      []string{"openid", "profile", "email"},
+			RoleClaim:   "groups",
+			DefaultRole: "user",
+		},
+		Login: LoginConfig{
+			FreeAttempts:    3,
+			MaxAttempts:     10,
+			IPFreeAttempts:  20,
+			IPMaxAttempts:   100,
+			BackoffBase:     time.Second,
+			LockoutDuration: 15 * time.Minute,
+			Window:          time.Hour,
+		},
+		RateLimit: RateLimitConfig{
+			Auth:  "20/1m",
+			Books: "300/1m",
+			Core:  "120/1m",
+			Admin: "60/1m",
+		},
+	}
+}
+
+// IsProduction reports whether the application runs in production mode
+func (c *Config) IsProduction() bool {
+	return c.Environment == EnvProduction
+}
+
+// Validate reports every invalid setting
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(slices.Contains([]string{EnvDev, EnvProduction}, c.Environment), "environment must be %s or %s, got %q", EnvDev, EnvProduction, c.Environment)
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server port %d is out of range", c.Server.Port)
+
+	check(c.JWT.Issuer != "", "jwt issuer is required")
+	check(c.JWT.Audience != "", "jwt audience is required")
+	check(c.JWT.AccessTokenTTL > 0, "jwt access token TTL must be positive")
+	check(c.JWT.RefreshTokenTTL > c.JWT.AccessTokenTTL, "jwt refresh token TTL must be longer than the access token TTL")
+	check(c.JWT.KeysDir == "" || c.JWT.KeysWatchInterval > 0, "jwt keys watch interval must be positive")
+	if c.IsProduction() && c.JWT.KeysDir == "" && c.JWT.PrivateKeyFile == "" {
+		secret := c.JWT.SigningSecret
+		check(secret != "" && secret != DefaultSigningSecret, "a JWT signing secret is required in production, set JWT_SIGNING_SECRET or JWT_SIGNING_SECRET_FILE")
+		check(secret == "" || secret == DefaultSigningSecret || len(secret) >= MinSigningSecretLength,
+			"the JWT signing secret must be at least %d characters in production", MinSigningSecretLength)
+	}
+
+	check(slices.Contains([]string{"memory", "sqlite", "file"}, c.Books.Storage), "unsupported book storage %q", c.Books.Storage)
+	check(c.Books.SeedFile != "", "books seed file is required")
+	check(c.Books.FileDebounce >= 0, "books file debounce must not be negative")
+	check(c.Books.Storage != "sqlite" || c.Books.SQLitePath != "", "books sqlite path is required")
+
+	check(slices.Contains([]string{"memory", "file"}, c.Users.Storage), "unsupported user storage %q", c.Users.Storage)
+	check(c.Users.Storage != "file" || c.Users.File != "", "users file is required")
+	check(slices.Contains([]string{"memory", "file"}, c.APIKeys.Storage), "unsupported API key storage %q", c.APIKeys.Storage)
+	check(c.APIKeys.Storage != "file" || c.APIKeys.File != "", "API keys file is required")
+	check(c.RBAC.PolicyFile != "", "rbac policy file is required")
+
+	check(c.Admin.MaxTokenAge >= 0, "admin max token age must not be negative")
+	if _, err := c.Admin.Networks(); err != nil {
+		errs = append(errs, err)
+	}
+
+	check(c.Login.FreeAttempts >= 0 && c.Login.MaxAttempts > c.Login.FreeAttempts, "login max attempts must be greater than the free attempts")
+	check(c.Login.IPFreeAttempts >= 0 && c.Login.IPMaxAttempts > c.Login.IPFreeAttempts, "login IP max attempts must be greater than the IP free attempts")
+	check(c.Login.BackoffBase > 0, "login backoff base must be positive")
+	check(c.Login.LockoutDuration >= c.Login.BackoffBase, "login lockout duration must not be shorter than the backoff base")
+	check(c.Login.Window >= c.Login.LockoutDuration, "login attempts window must not be shorter than the lockout duration")
+
+	if _, err := c.RateLimit.Groups(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.OIDC.Enabled() {
+		check(c.OIDC.ClientID != "", "oidc client id is required")
+		check(c.OIDC.RedirectURL != "", "oidc redirect URL is required")
+		check(slices.Contains(c.OIDC.Scopes, "openid"), "oidc scopes must include openid")
+		check(c.OIDC.DefaultRole != "", "oidc default role is required")
+		check(!c.IsProduction() || strings.HasPrefix(c.OIDC.Issuer, "https://"), "the oidc issuer must use https in production")
+		if _, err := c.OIDC.Mappings(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// BookFile returns the JSON file of the file book storage
+func (c BooksConfig) BookFile() string {
+	if c.File != "" {
+		return c.File
+	}
+	return c.SeedFile
+}
+
+// Networks parses the allowed IPs, a single address is a range of one address
+func (c AdminConfig) Networks() ([]netip.Prefix, error) {
+	networks := make([]netip.Prefix, 0, len(c.AllowedIPs))
+	for _, s := range c.AllowedIPs {
+		if addr, err := netip.ParseAddr(s); err == nil {
+			networks = append(networks, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin allowed IP %q, expected an address or a CIDR range", s)
+		}
+		networks = append(networks, prefix.Masked())
+	}
+	return networks, nil
+}
+
+// Enabled reports whether logins are delegated to an OpenID Connect provider
+func (c OIDCConfig) Enabled() bool {
+	return c.Issuer != ""
+}
+
+// RoleMapping maps a value of the role claim of the provider to a local role
+type RoleMapping struct {
+	Value string
+	Role  string
+}
+
+// Mappings parses the role mappings, in order of precedence
+func (c OIDCConfig) Mappings() ([]RoleMapping, error) {
+	mappings := make([]RoleMapping, 0, len(c.RoleMappings))
+	for _, s := range c.RoleMappings {
+		value, role, ok := strings.Cut(s, "=")
+		if !ok || value == "" || role == "" {
+			return nil, fmt.Errorf("invalid oidc role mapping %q, expected <claim value>=<role>", s)
+		}
+		mappings = append(mappings, RoleMapping{Value: value, Role: role})
+	}
+	return mappings, nil
+}
+
+// normalize cleans up values before validation
+func (c *Config) normalize() {
+	c.Environment = strings.ToLower(strings.TrimSpace(c.Environment))
+	if c.Environment == "prod" {
+		c.Environment = EnvProduction
+	}
+}
+
+// RateLimit allows Requests per Period, in bursts of up to Requests
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// Groups parses the limits by group of routes, disabled groups are left out
+func (c RateLimitConfig) Groups() (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit)
+	for group, s := range map[string]string{"auth": c.Auth, "books": c.Books, "core": c.Core, "admin": c.Admin} {
+		if s == "" || s == "off" {
+			continue
+		}
+		requests, period, ok := strings.Cut(s, "/")
+		limit := RateLimit{}
+		var err error
+		if ok {
+			if limit.Requests, err = strconv.Atoi(requests); err == nil {
+				limit.Period, err = time.ParseDuration(period)
+			}
+		}
+		if !ok || err != nil || limit.Requests <= 0 || limit.Period <= 0 {
+			return nil, fmt.Errorf("invalid %s rate limit %q, expected <requests>/<period> such as 100/1m", group, s)
+		}
+		limits[group] = limit
+	}
+	return limits, nil
+}
@@ -0,0 +1,259 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jkaninda/logger"
+	"gopkg.in/yaml.v3"
+)
+
+// setting binds a configuration value to its environment variable and command line flag
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	value flag.Value
+}
+
+func settings(c *Config) []setting {
+	return []setting{
+		{"APP_ENV", "env", "Environment: dev or production", stringVar(&c.Environment)},
+		{"PORT", "port", "HTTP port", intVar(&c.Server.Port)},
+		{"TRUST_PROXY_HEADERS", "trust-proxy-headers", "Take the client address from X-Forwarded-For, only behind a proxy overwriting it", boolVar(&c.Proxy.TrustHeaders)},
+		{"JWT_SIGNING_SECRET", "jwt-signing-secret", "HMAC secret tokens are signed with", stringVar(&c.JWT.SigningSecret)},
+		{"JWT_SIGNING_SECRET_FILE", "jwt-signing-secret-file", "File holding the HMAC secret", stringVar(&c.JWT.SigningSecretFile)},
+		{"JWT_PRIVATE_KEY_FILE", "jwt-private-key-file", "PEM encoded RSA, ECDSA or Ed25519 private key tokens are signed with", stringVar(&c.JWT.PrivateKeyFile)},
+		{"JWT_KEY_ID", "jwt-key-id", "kid of the private key, its thumbprint by default", stringVar(&c.JWT.KeyID)},
+		{"JWT_KEYS_DIR", "jwt-keys-dir", "Directory of <kid>.pem keys, the newest one signs tokens", stringVar(&c.JWT.KeysDir)},
+		{"JWT_KEYS_WATCH_INTERVAL", "jwt-keys-watch-interval", "How often the keys directory is checked for new keys", durationVar(&c.JWT.KeysWatchInterval)},
+		{"JWT_ISSUER", "jwt-issuer", "Issuer of the tokens", stringVar(&c.JWT.Issuer)},
+		{"JWT_AUDIENCE", "jwt-audience", "Audience of the tokens", stringVar(&c.JWT.Audience)},
+		{"JWT_ACCESS_TOKEN_TTL", "jwt-access-token-ttl", "Lifetime of access tokens", durationVar(&c.JWT.AccessTokenTTL)},
+		{"JWT_REFRESH_TOKEN_TTL", "jwt-refresh-token-ttl", "Lifetime of refresh tokens", durationVar(&c.JWT.RefreshTokenTTL)},
+		{"BOOK_STORAGE", "book-storage", "Book storage: memory, sqlite or file", stringVar(&c.Books.Storage)},
+		{"BOOK_SEED_FILE", "book-seed-file", "Demo books loaded into an empty storage", stringVar(&c.Books.SeedFile)},
+		{"BOOK_FILE", "book-file", "JSON file of the file storage, the seed file by default", stringVar(&c.Books.File)},
+		{"BOOK_FILE_DEBOUNCE", "book-file-debounce", "Delay to batch writes of the file storage", durationVar(&c.Books.FileDebounce)},
+		{"BOOK_FILE_FSYNC", "book-file-fsync", "Fsync the file storage on every write", boolVar(&c.Books.FileFsync)},
+		{"SQLITE_PATH", "sqlite-path", "Database file of the sqlite storage", stringVar(&c.Books.SQLitePath)},
+		{"USER_STORAGE", "user-storage", "User storage: memory or file", stringVar(&c.Users.Storage)},
+		{"USERS_FILE", "users-file", "JSON file of the file user storage", stringVar(&c.Users.File)},
+		{"API_KEY_STORAGE", "api-key-storage", "API key storage: memory or file", stringVar(&c.APIKeys.Storage)},
+		{"API_KEYS_FILE", "api-keys-file", "JSON file of the file API key storage", stringVar(&c.APIKeys.File)},
+		{"RBAC_POLICY_FILE", "rbac-policy-file", "YAML file granting permissions to roles", stringVar(&c.RBAC.PolicyFile)},
+		{"ADMIN_MAX_TOKEN_AGE", "admin-max-token-age", "Maximum time since the login of tokens on admin routes, 0 disables the check", durationVar(&c.Admin.MaxTokenAge)},
+		{"ADMIN_REQUIRE_MFA", "admin-require-mfa", "Require multi-factor authentication on admin routes", boolVar(&c.Admin.RequireMFA)},
+		{"ADMIN_ALLOWED_IPS", "admin-allowed-ips", "Comma-separated addresses or CIDR ranges allowed on admin routes", listVar(&c.Admin.AllowedIPs)},
+		{"OIDC_ISSUER", "oidc-issuer", "URL of the OpenID Connect provider logins are delegated to", stringVar(&c.OIDC.Issuer)},
+		{"OIDC_CLIENT_ID", "oidc-client-id", "OAuth2 client ID registered with the provider", stringVar(&c.OIDC.ClientID)},
+		{"OIDC_CLIENT_SECRET", "oidc-client-secret", "OAuth2 client secret, empty for public clients", stringVar(&c.OIDC.ClientSecret)},
+		{"OIDC_REDIRECT_URL", "oidc-redirect-url", "URL of /auth/oidc/callback registered with the provider", stringVar(&c.OIDC.RedirectURL)},
+		{"OIDC_SCOPES", "oidc-scopes", "Comma-separated scopes requested from the provider", listVar(&c.OIDC.Scopes)},
+		{"OIDC_ROLE_CLAIM", "oidc-role-claim", "ID token claim mapped to a local role", stringVar(&c.OIDC.RoleClaim)},
+		{"OIDC_ROLE_MAPPINGS", "oidc-role-mappings", "Comma-separated <claim value>=<role> rules, the first match wins", listVar(&c.OIDC.RoleMappings)},
+		{"OIDC_DEFAULT_ROLE", "oidc-default-role", "Role granted when no mapping matches", stringVar(&c.OIDC.DefaultRole)},
+		{"LOGIN_FREE_ATTEMPTS", "login-free-attempts", "Failed logins per username before they are delayed", intVar(&c.Login.FreeAttempts)},
+		{"LOGIN_MAX_ATTEMPTS", "login-max-attempts", "Failed logins per username before it is locked out", intVar(&c.Login.MaxAttempts)},
+		{"LOGIN_IP_FREE_ATTEMPTS", "login-ip-free-attempts", "Failed logins per client address before they are delayed", intVar(&c.Login.IPFreeAttempts)},
+		{"LOGIN_IP_MAX_ATTEMPTS", "login-ip-max-attempts", "Failed logins per client address before it is locked out", intVar(&c.Login.IPMaxAttempts)},
+		{"LOGIN_BACKOFF_BASE", "login-backoff-base", "Delay after the first failure beyond the free attempts, doubled on every failure", durationVar(&c.Login.BackoffBase)},
+		{"LOGIN_LOCKOUT_DURATION", "login-lockout-duration", "How long a username or client address is locked out", durationVar(&c.Login.LockoutDuration)},
+		{"LOGIN_ATTEMPTS_WINDOW", "login-attempts-window", "How long failed logins are remembered after the last one", durationVar(&c.Login.Window)},
+		{"RATE_LIMIT_AUTH", "rate-limit-auth", "Requests per client to /auth, as <requests>/<period>, off disables the limit", stringVar(&c.RateLimit.Auth)},
+		{"RATE_LIMIT_BOOKS", "rate-limit-books", "Requests per client to /books and /api/books", stringVar(&c.RateLimit.Books)},
+		{"RATE_LIMIT_CORE", "rate-limit-core", "Requests per client to /core", stringVar(&c.RateLimit.Core)},
+		{"RATE_LIMIT_ADMIN", "rate-limit-admin", "Requests per client to /admin", stringVar(&c.RateLimit.Admin)},
+	}
+}
+
+// Load builds the configuration from the defaults, the configuration file, the environment
+// and the command line arguments, each overriding the previous ones, and validates it.
+// The configuration file is set with -config or CONFIG_FILE, YAML and TOML files are supported.
+func Load(args []string) (*Config, error) {
+	// Parse the flags once to find the configuration file, they are applied on top of it below
+	path := os.Getenv("CONFIG_FILE")
+	if err := newFlagSet(Default(), &path).Parse(args); err != nil {
+		return nil, err
+	}
+	c := Default()
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.loadEnv(); err != nil {
+		return nil, err
+	}
+	if err := newFlagSet(c, &path).Parse(args); err != nil {
+		return nil, err
+	}
+	if c.JWT.SigningSecretFile != "" {
+		data, err := os.ReadFile(c.JWT.SigningSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the JWT signing secret file: %w", err)
+		}
+		c.JWT.SigningSecret = strings.TrimSpace(string(data))
+	}
+	c.normalize()
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	c.applyDevDefaults()
+	return c, nil
+}
+
+func newFlagSet(c *Config, path *string) *flag.FlagSet {
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	fs.StringVar(path, "config", *path, "YAML or TOML configuration file (env CONFIG_FILE)")
+	for _, s := range settings(c) {
+		fs.Var(s.value, s.flag, fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	return fs
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %w", err)
+	}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err = decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to parse configuration file %s: %w", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("failed to parse configuration file %s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("failed to parse configuration file %s: unknown field %q", path, undecoded[0].String())
+		}
+	default:
+		return fmt.Errorf("unsupported configuration file format %q, use .yaml, .yml or .toml", ext)
+	}
+	logger.Info("Configuration loaded", "file", path)
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	for _, s := range settings(c) {
+		value, ok := os.LookupEnv(s.env)
+		if !ok || value == "" {
+			continue
+		}
+		if err := s.value.Set(value); err != nil {
+			return fmt.Errorf("invalid %s: %w", s.env, err)
+		}
+	}
+	return nil
+}
+
+// applyDevDefaults falls back to the default signing secret in dev mode,
+// and warns loudly about the insecure settings production mode refuses
+func (c *Config) applyDevDefaults() {
+	if c.IsProduction() || c.JWT.KeysDir != "" || c.JWT.PrivateKeyFile != "" {
+		return
+	}
+	switch secret := c.JWT.SigningSecret; {
+	case secret == "" || secret == DefaultSigningSecret:
+		c.JWT.SigningSecret = DefaultSigningSecret
+		logger.Warn("**************************************************************************")
+		logger.Warn("* Signing JWT tokens with the default secret, anyone can forge tokens.   *")
+		logger.Warn("* Set JWT_SIGNING_SECRET and never run with the default in production.   *")
+		logger.Warn("**************************************************************************")
+	case len(secret) < MinSigningSecretLength:
+		logger.Warn("The JWT signing secret is too short for production mode", "length", len(secret), "minimum", MinSigningSecretLength)
+	}
+}
+
+// value is a flag.Value setting a configuration field
+type value[T any] struct {
+	p      *T
+	parse  func(string) (T, error)
+	isBool bool
+}
+
+func (v value[T]) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return fmt.Sprint(*v.p)
+}
+
+func (v value[T]) Set(s string) error {
+	parsed, err := v.parse(s)
+	if err != nil {
+		return err
+	}
+	*v.p = parsed
+	return nil
+}
+
+// IsBoolFlag allows boolean flags without a value, e.g. -book-file-fsync
+func (v value[T]) IsBoolFlag() bool { return v.isBool }
+
+func stringVar(p *string) flag.Value {
+	return value[string]{p: p, parse: func(s string) (string, error) { return s, nil }}
+}
+
+func intVar(p *int) flag.Value {
+	return value[int]{p: p, parse: strconv.Atoi}
+}
+
+func boolVar(p *bool) flag.Value {
+	return value[bool]{p: p, parse: strconv.ParseBool, isBool: true}
+}
+
+func durationVar(p *time.Duration) flag.Value {
+	return value[time.Duration]{p: p, parse: time.ParseDuration}
+}
+
+// listVar parses a comma-separated list, ignoring empty items
+func listVar(p *[]string) flag.Value {
+	return value[[]string]{p: p, parse: func(s string) ([]string, error) {
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items, nil
+	}}
+}
@@ -0,0 +1,319 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jkaninda/okapi"
+	"github.com/jkaninda/okapi-example/middlewares"
+	"github.com/jkaninda/okapi-example/models"
+	"github.com/jkaninda/okapi-example/repositories"
+	"github.com/jkaninda/okapi-example/utils"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultRole is granted to self-registered users
+	defaultRole       = "user"
+	minPasswordLength = 8
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{3,32}$`)
+
+// ******************** Account management *****************
+
+// Register creates a new user account with the default role
+func (bc *AuthController) Register(c okapi.Context) error {
+	req := &models.RegisterRequest{}
+	err := c.Bind(req)
+	if err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	if !usernamePattern.MatchString(req.Username) {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: "username must be 3 to 32 letters, digits, dots, dashes or underscores", RequestID: middlewares.GetRequestID(c)})
+	}
+	if err = validateProfile(req.Email, req.Password); err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	hash, err := utils.HashPassword(req.Password)
+	if err != nil {
+		return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	user := &models.User{
+		Username:     req.Username,
+		Name:         req.Name,
+		Email:        req.Email,
+		PasswordHash: hash,
+		Role:         defaultRole,
+		Permissions:  middlewares.Policy().Permissions(defaultRole),
+	}
+	if err = bc.users.Create(user); err != nil {
+		return bc.userStoreError(c, err)
+	}
+	middlewares.Log(c).Info("User registered", "username", user.Username)
+	return c.Created(userInfo(user))
+}
+
+// Me returns the account of the authenticated user
+func (bc *AuthController) Me(c okapi.Context) error {
+	user, err := bc.currentUser(c)
+	if err != nil {
+		return bc.userStoreError(c, err)
+	}
+	return c.OK(userInfo(user))
+}
+
+// UpdateMe updates the profile of the authenticated user
+func (bc *AuthController) UpdateMe(c okapi.Context) error {
+	req := &models.UpdateProfileRequest{}
+	err := c.Bind(req)
+	if err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	if _, err = mail.ParseAddress(req.Email); err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: "invalid email address", RequestID: middlewares.GetRequestID(c)})
+	}
+	user, err := bc.users.Update(c.GetString("username"), func(user *models.User) error {
+		user.Name = req.Name
+		if !strings.EqualFold(user.Email, req.Email) {
+			// The new address has not been verified
+			user.EmailVerified = false
+		}
+		user.Email = req.Email
+		return nil
+	})
+	if err != nil {
+		return bc.userStoreError(c, err)
+	}
+	return c.OK(userInfo(user))
+}
+
+// ChangePassword replaces the password of the authenticated user after checking the current one
+func (bc *AuthController) ChangePassword(c okapi.Context) error {
+	req := &models.ChangePasswordRequest{}
+	err := c.Bind(req)
+	if err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	if len(req.NewPassword) < minPasswordLength {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: fmt.Sprintf("password must be at least %d characters", minPasswordLength), RequestID: middlewares.GetRequestID(c)})
+	}
+	current, err := repositories.Authenticate(bc.users, c.GetString("username"), req.CurrentPassword)
+	var user *models.User
+	if err == nil {
+		var hash string
+		if hash, err = utils.HashPassword(req.NewPassword); err != nil {
+			return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+		}
+		user, err = bc.users.Update(current.Username, func(user *models.User) error {
+			// The password was changed by another request since it was checked
+			if user.PasswordHash != current.PasswordHash {
+				return repositories.ErrInvalidCredentials
+			}
+			user.PasswordHash = hash
+			return nil
+		})
+	}
+	if err != nil {
+		if errors.Is(err, repositories.ErrInvalidCredentials) {
+			return c.ErrorForbidden(models.ErrorResponse{Success: false, Status: http.StatusForbidden, Details: "current password is wrong", RequestID: middlewares.GetRequestID(c)})
+		}
+		return bc.userStoreError(c, err)
+	}
+	// Sessions opened with the old password can no longer be refreshed
+	if err = bc.refreshTokens.RevokeUser(user.Username); err != nil {
+		middlewares.Log(c).Error("Failed to revoke refresh tokens", "username", user.Username, "error", err)
+	}
+	middlewares.Log(c).Info("Password changed", "username", user.Username)
+	return c.OK(userInfo(user))
+}
+
+// ******************** User administration *****************
+
+// ListUsers returns all user accounts
+func (bc *AuthController) ListUsers(c okapi.Context) error {
+	users, err := bc.users.List()
+	if err != nil {
+		return bc.userStoreError(c, err)
+	}
+	infos := make([]models.UserInfo, 0, len(users))
+	for _, user := range users {
+		infos = append(infos, userInfo(user))
+	}
+	return c.OK(infos)
+}
+
+// DisableUser prevents a user from logging in
+func (bc *AuthController) DisableUser(c okapi.Context) error {
+	return bc.setDisabled(c, true)
+}
+
+// EnableUser allows a disabled user to log in again
+func (bc *AuthController) EnableUser(c okapi.Context) error {
+	return bc.setDisabled(c, false)
+}
+
+// VerifyEmail marks the email of a user as verified, so that the /core and /admin routes accept their tokens
+func (bc *AuthController) VerifyEmail(c okapi.Context) error {
+	user, err := bc.users.Update(c.Param("username"), func(user *models.User) error {
+		user.EmailVerified = true
+		return nil
+	})
+	if err != nil {
+		return bc.userStoreError(c, err)
+	}
+	middlewares.Log(c).Info("User email verified", "username", user.Username, "email", user.Email, "by", c.GetString("username"))
+	return c.OK(userInfo(user))
+}
+
+// ChangeRole assigns a role to a user, replacing their permissions with those of the role
+func (bc *AuthController) ChangeRole(c okapi.Context) error {
+	req := &models.ChangeRoleRequest{}
+	err := c.Bind(req)
+	if err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	policy := middlewares.Policy()
+	if !policy.HasRole(req.Role) {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: fmt.Sprintf("unknown role %q", req.Role), RequestID: middlewares.GetRequestID(c)})
+	}
+	user, err := bc.users.Update(c.Param("username"), func(user *models.User) error {
+		user.Role = req.Role
+		user.Permissions = policy.Permissions(req.Role)
+		return nil
+	})
+	if err != nil {
+		return bc.userStoreError(c, err)
+	}
+	middlewares.Log(c).Info("User role changed", "username", user.Username, "role", user.Role, "by", c.GetString("username"))
+	return c.OK(userInfo(user))
+}
+
+// RevokeToken revokes a JWT token by its ID, it is rejected until it expires
+func (bc *AuthController) RevokeToken(c okapi.Context) error {
+	req := &models.RevokeTokenRequest{}
+	err := c.Bind(req)
+	if err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	// The expiration of the token is unknown, deny it for the longest lifetime a token can have
+	if err = bc.denylist.Revoke(req.Jti, time.Now().Add(bc.config.JWT.AccessTokenTTL)); err != nil {
+		middlewares.Log(c).Error("Failed to revoke token", "jti", req.Jti, "error", err)
+		return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	middlewares.Log(c).Info("Token revoked", "jti", req.Jti, "by", c.GetString("username"))
+	return c.OK(models.AuthResponse{Success: true, Message: "Token revoked"})
+}
+
+// ListKeys returns the active JWT signing key and the previous keys still verifying tokens
+func (bc *AuthController) ListKeys(c okapi.Context) error {
+	return c.OK(middlewares.Keys().Keys())
+}
+
+// RotateKey signs new tokens with a freshly generated key of the same type as the active key.
+// Tokens signed with the previous key stay valid until they expire.
+func (bc *AuthController) RotateKey(c okapi.Context) error {
+	keyring := middlewares.Keys()
+	key, err := middlewares.GenerateKey(keyring.Active())
+	if err == nil {
+		err = keyring.Rotate(key)
+	}
+	if err != nil {
+		middlewares.Log(c).Error("Failed to rotate JWT signing key", "error", err)
+		return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	middlewares.Log(c).Info("JWT signing key rotation requested", "kid", key.ID, "by", c.GetString("username"))
+	return c.OK(keyring.Keys())
+}
+
+func (bc *AuthController) setDisabled(c okapi.Context, disabled bool) error {
+	username := c.Param("username")
+	if disabled && username == c.GetString("username") {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: "you can not disable your own account", RequestID: middlewares.GetRequestID(c)})
+	}
+	user, err := bc.users.Update(username, func(user *models.User) error {
+		user.Disabled = disabled
+		return nil
+	})
+	if err != nil {
+		return bc.userStoreError(c, err)
+	}
+	if disabled {
+		if err = bc.refreshTokens.RevokeUser(user.Username); err != nil {
+			middlewares.Log(c).Error("Failed to revoke refresh tokens", "username", user.Username, "error", err)
+		}
+	}
+	middlewares.Log(c).Info("User status changed", "username", user.Username, "disabled", disabled, "by", c.GetString("username"))
+	return c.OK(userInfo(user))
+}
+
+// currentUser loads the user identified by the username forwarded from the JWT
+func (bc *AuthController) currentUser(c okapi.Context) (*models.User, error) {
+	username := c.GetString("username")
+	if username == "" {
+		return nil, repositories.ErrUserNotFound
+	}
+	return bc.users.Get(username)
+}
+
+// userStoreError maps user store errors to HTTP responses
+func (bc *AuthController) userStoreError(c okapi.Context, err error) error {
+	switch {
+	case errors.Is(err, repositories.ErrUserNotFound):
+		return c.ErrorNotFound(models.ErrorResponse{Success: false, Status: http.StatusNotFound, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	case errors.Is(err, repositories.ErrUserExists), errors.Is(err, repositories.ErrEmailExists):
+		return c.ErrorConflict(models.ErrorResponse{Success: false, Status: http.StatusConflict, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	middlewares.Log(c).Error("User store error", "error", err)
+	return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+}
+
+func validateProfile(email, password string) error {
+	if _, err := mail.ParseAddress(email); err != nil {
+		return errors.New("invalid email address")
+	}
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	return nil
+}
+
+func userInfo(user *models.User) models.UserInfo {
+	return models.UserInfo{
+		Username:      user.Username,
+		Name:          user.Name,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Role:          user.Role,
+		Permissions:   user.Permissions,
+		Disabled:      user.Disabled,
+		MFAEnabled:    user.TOTPEnabled,
+	}
+}
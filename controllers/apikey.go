@@ -0,0 +1,135 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jkaninda/okapi"
+	"github.com/jkaninda/okapi-example/middlewares"
+	"github.com/jkaninda/okapi-example/models"
+	"github.com/jkaninda/okapi-example/repositories"
+	"net/http"
+	"time"
+)
+
+// APIKeyController manages the API keys services authenticate with
+type APIKeyController struct {
+	keys repositories.APIKeyStore
+}
+
+// NewAPIKeyController creates an APIKeyController backed by the given store
+func NewAPIKeyController(keys repositories.APIKeyStore) *APIKeyController {
+	return &APIKeyController{keys: keys}
+}
+
+// ListAPIKeys returns all API keys, without their secret
+func (ac *APIKeyController) ListAPIKeys(c okapi.Context) error {
+	keys, err := ac.keys.List()
+	if err != nil {
+		return ac.apiKeyStoreError(c, err)
+	}
+	infos := make([]models.APIKeyInfo, 0, len(keys))
+	for _, key := range keys {
+		infos = append(infos, apiKeyInfo(key))
+	}
+	return c.OK(infos)
+}
+
+// CreateAPIKey generates an API key granted some of the permissions of the current user.
+// The key is returned once, only its hash is stored.
+func (ac *APIKeyController) CreateAPIKey(c okapi.Context) error {
+	req := &models.CreateAPIKeyRequest{}
+	err := c.Bind(req)
+	if err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	if len(req.Permissions) == 0 {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: "at least one permission is required", RequestID: middlewares.GetRequestID(c)})
+	}
+	var ttl time.Duration
+	if req.ExpiresIn != "" {
+		if ttl, err = time.ParseDuration(req.ExpiresIn); err != nil || ttl <= 0 {
+			return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: fmt.Sprintf("invalid expiresIn %q, expected a positive duration such as 720h", req.ExpiresIn), RequestID: middlewares.GetRequestID(c)})
+		}
+	}
+	// Keys can not grant more than their creator holds
+	for _, permission := range req.Permissions {
+		if !middlewares.Allowed(c, permission) {
+			return c.ErrorForbidden(models.ErrorResponse{Success: false, Status: http.StatusForbidden, Details: "you can not grant permission " + permission, RequestID: middlewares.GetRequestID(c)})
+		}
+	}
+	raw, key, err := middlewares.NewAPIKey(req.Name, req.Permissions, c.GetString("username"), ttl)
+	if err != nil {
+		return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	if err = ac.keys.Create(key); err != nil {
+		return ac.apiKeyStoreError(c, err)
+	}
+	middlewares.Log(c).Info("API key created", "id", key.ID, "name", key.Name, "permissions", key.Permissions, "by", key.CreatedBy)
+	return c.Created(models.CreatedAPIKey{Key: raw, APIKeyInfo: apiKeyInfo(key)})
+}
+
+// RevokeAPIKey invalidates an API key
+func (ac *APIKeyController) RevokeAPIKey(c okapi.Context) error {
+	id := c.Param("id")
+	if err := ac.keys.Revoke(id); err != nil {
+		return ac.apiKeyStoreError(c, err)
+	}
+	key, err := ac.keys.Get(id)
+	if err != nil {
+		return ac.apiKeyStoreError(c, err)
+	}
+	middlewares.Log(c).Info("API key revoked", "id", key.ID, "name", key.Name, "by", c.GetString("username"))
+	return c.OK(apiKeyInfo(key))
+}
+
+// apiKeyStoreError maps API key store errors to HTTP responses
+func (ac *APIKeyController) apiKeyStoreError(c okapi.Context, err error) error {
+	if errors.Is(err, repositories.ErrAPIKeyNotFound) {
+		return c.ErrorNotFound(models.ErrorResponse{Success: false, Status: http.StatusNotFound, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	middlewares.Log(c).Error("API key store error", "error", err)
+	return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+}
+
+func apiKeyInfo(key *models.APIKey) models.APIKeyInfo {
+	info := models.APIKeyInfo{
+		ID:          key.ID,
+		Prefix:      middlewares.APIKeyPrefix(key.ID),
+		Name:        key.Name,
+		Permissions: key.Permissions,
+		CreatedBy:   key.CreatedBy,
+		CreatedAt:   key.CreatedAt,
+		Revoked:     key.Revoked,
+	}
+	if !key.ExpiresAt.IsZero() {
+		info.ExpiresAt = &key.ExpiresAt
+	}
+	if !key.LastUsedAt.IsZero() {
+		info.LastUsedAt = &key.LastUsedAt
+	}
+	return info
+}
@@ -26,27 +26,58 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/jkaninda/logger"
+	jsonpatch "github.com/evanphx/json-patch/v5"
 	"github.com/jkaninda/okapi"
+	"github.com/jkaninda/okapi-example/config"
 	"github.com/jkaninda/okapi-example/middlewares"
 	"github.com/jkaninda/okapi-example/models"
+	"github.com/jkaninda/okapi-example/oidc"
+	"github.com/jkaninda/okapi-example/repositories"
+	"github.com/jkaninda/okapi-example/search"
+	"io"
+	"math"
 	"net/http"
-	"os"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 )
 
-type BookController struct{}
+// maxPageSize is the largest page of a book listing, see models.BookQuery
+const maxPageSize = 100
+
+// jsonPatchContentType selects RFC 6902 JSON Patch semantics for PATCH requests
+const jsonPatchContentType = "application/json-patch+json"
+
+type BookController struct {
+	repo  repositories.BookRepository
+	index *search.Index
+}
 type HomeController struct{}
-type AuthController struct{}
+type AuthController struct {
+	config        *config.Config
+	users         repositories.UserStore
+	refreshTokens repositories.RefreshTokenStore
+	denylist      repositories.TokenDenylist
+	// loginGuard throttles the one-time passwords checked by the two-factor authentication settings
+	loginGuard *middlewares.LoginGuard
+	// oidc is the OpenID Connect provider logins are delegated to, nil when disabled
+	oidc *oidc.Provider
+}
 
-var (
-	books = []*models.Book{
-		{Id: 1, Title: "Book One", Price: 100},
-		{Id: 2, Title: "Book Two", Price: 200},
-		{Id: 3, Title: "Book Three", Price: 300},
-	}
-)
+// NewAuthController creates an AuthController authenticating against the given user store
+// and keeping track of issued refresh tokens in refreshTokens and of revoked JWT tokens in denylist.
+// Invalid one-time passwords are counted by loginGuard, shared with the login route.
+func NewAuthController(cfg *config.Config, users repositories.UserStore, refreshTokens repositories.RefreshTokenStore, denylist repositories.TokenDenylist, loginGuard *middlewares.LoginGuard) *AuthController {
+	return &AuthController{config: cfg, users: users, refreshTokens: refreshTokens, denylist: denylist, loginGuard: loginGuard}
+}
+
+// NewBookController creates a BookController backed by the given repository and search index
+func NewBookController(repo repositories.BookRepository, index *search.Index) *BookController {
+	return &BookController{repo: repo, index: index}
+}
 
 // ****************** Controllers *****************
 
@@ -57,7 +88,7 @@ func (hc *HomeController) Home(c okapi.Context) error {
 func (hc *HomeController) WhoAmI(c okapi.Context) error {
 	email := c.Header("current_user_email")
 	if email == "" {
-		logger.Warn("no email found")
+		middlewares.Log(c).Warn("no email found")
 	}
 	return c.OK(models.WhoAmIResponse{
 		Host:   c.Request().Host,
@@ -70,49 +101,281 @@ func (hc *HomeController) WhoAmI(c okapi.Context) error {
 	})
 }
 func (bc *BookController) GetBooks(c okapi.Context) error {
-	_, err := bc.readBooksFromFile()
+	query := &models.BookQuery{}
+	err := c.Bind(query)
+	if err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	// Checked again as values bound from a request body skip the min and max tags,
+	// the page is bounded so that its offset does not overflow
+	if query.PageSize < 1 || query.PageSize > maxPageSize {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: fmt.Sprintf("pageSize must be between 1 and %d", maxPageSize), RequestID: middlewares.GetRequestID(c)})
+	}
+	if maxPage := math.MaxInt / query.PageSize; query.Page < 1 || query.Page > maxPage {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: fmt.Sprintf("page must be between 1 and %d", maxPage), RequestID: middlewares.GetRequestID(c)})
+	}
+	sortFields, err := repositories.ParseSort(query.Sort)
+	if err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	books, total, err := bc.repo.Find(repositories.BookFilter{
+		Author:   query.Author,
+		Country:  query.Country,
+		Language: query.Language,
+		MinYear:  query.MinYear,
+		MaxYear:  query.MaxYear,
+		MinPrice: query.MinPrice,
+		MaxPrice: query.MaxPrice,
+		Sort:     sortFields,
+		Offset:   (query.Page - 1) * query.PageSize,
+		Limit:    query.PageSize,
+	})
 	if err != nil {
-		logger.Error("Error reading books from file", "error", err)
-		return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error()})
+		middlewares.Log(c).Error("Error listing books", "error", err)
+		return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	page := models.BookPage{
+		Data:       make([]models.Book, 0, len(books)),
+		Total:      total,
+		Page:       query.Page,
+		PageSize:   query.PageSize,
+		TotalPages: (total + query.PageSize - 1) / query.PageSize,
+	}
+	for _, book := range books {
+		page.Data = append(page.Data, *book)
+	}
+	if link := paginationLinks(c.Request().URL, page); link != "" {
+		c.SetHeader("Link", link)
+	}
+	return c.OK(page)
+}
+
+// paginationLinks builds an RFC 8288 Link header pointing to the first, previous, next and last pages
+func paginationLinks(u *url.URL, page models.BookPage) string {
+	pageURL := func(n int) string {
+		q := u.Query()
+		q.Set("page", strconv.Itoa(n))
+		q.Set("pageSize", strconv.Itoa(page.PageSize))
+		return (&url.URL{Path: u.Path, RawQuery: q.Encode()}).String()
+	}
+	if page.TotalPages == 0 {
+		return ""
+	}
+	links := []string{fmt.Sprintf("<%s>; rel=\"first\"", pageURL(1))}
+	if page.Page > 1 {
+		links = append(links, fmt.Sprintf("<%s>; rel=\"prev\"", pageURL(min(page.Page-1, page.TotalPages))))
 	}
-	return c.OK(books)
+	if page.Page < page.TotalPages {
+		links = append(links, fmt.Sprintf("<%s>; rel=\"next\"", pageURL(page.Page+1)))
+	}
+	links = append(links, fmt.Sprintf("<%s>; rel=\"last\"", pageURL(page.TotalPages)))
+	return strings.Join(links, ", ")
 }
 
 func (bc *BookController) CreateBook(c okapi.Context) error {
-	// Simulate creating a book in a database
 	book := &models.Book{}
 	err := c.Bind(book)
 	if err != nil {
-		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error()})
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	// IDs and timestamps are managed by the repository
+	book.Id = 0
+	book.CreatedAt, book.UpdatedAt = time.Time{}, time.Time{}
+	// The book belongs to the authenticated user, whatever the request says
+	book.OwnerID = c.GetString("username")
+	err = bc.repo.Create(book)
+	if err != nil {
+		middlewares.Log(c).Error("Error creating book", "error", err)
+		return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
 	}
-	book.Id = len(books) + 1
-	books = append(books, book)
 	response := models.Response{
 		Success: true,
 		Message: "Book created successfully",
 		Data:    *book,
 	}
+	c.SetHeader("ETag", etag(book))
 	return c.OK(response)
 }
+
+// SearchBooks performs a full-text search over book titles and authors
+func (bc *BookController) SearchBooks(c okapi.Context) error {
+	query := &models.SearchQuery{}
+	err := c.Bind(query)
+	if err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	hits, total := bc.index.Search(query.Q, query.Limit)
+	response := models.SearchResponse{
+		Query:   query.Q,
+		Total:   total,
+		Results: make([]models.SearchResult, 0, len(hits)),
+	}
+	for _, hit := range hits {
+		response.Results = append(response.Results, models.SearchResult{
+			Book:  hit.Book,
+			Score: hit.Score,
+			Highlights: models.SearchHighlight{
+				Title:  hit.Title,
+				Author: hit.Author,
+			},
+		})
+	}
+	return c.OK(response)
+}
+
 func (bc *BookController) GetBook(c okapi.Context) error {
 	id := c.Param("id")
 	i, err := strconv.Atoi(id)
 	if err != nil {
-		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error()})
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	book, err := bc.repo.Get(i)
+	if err != nil {
+		return bc.repositoryError(c, err)
 	}
-	// Simulate a fetching book from a database
+	c.SetHeader("ETag", etag(book))
+	return c.OK(book)
+}
 
-	_, err = bc.readBooksFromFile()
+// UpdateBook replaces an existing book
+func (bc *BookController) UpdateBook(c okapi.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		logger.Error("Error reading books from file", "error", err)
-		return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error()})
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
 	}
-	for _, book := range books {
-		if book.Id == i {
-			return c.OK(book)
+	book := &models.Book{}
+	err = c.Bind(book)
+	if err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	book.Id = id
+	version, ok := ifMatch(c)
+	if !ok {
+		return preconditionFailed(c)
+	}
+	return bc.saveBook(c, book, version, "Book updated successfully")
+}
+
+// PatchBook partially updates a book.
+// The request body is applied as a JSON Patch (RFC 6902) when sent with the
+// application/json-patch+json content type, and as a JSON Merge Patch (RFC 7396) otherwise.
+func (bc *BookController) PatchBook(c okapi.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	patch, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	book, err := bc.repo.Get(id)
+	if err != nil {
+		return bc.repositoryError(c, err)
+	}
+	if version, ok := ifMatch(c); !ok || !version.IsZero() && !book.UpdatedAt.Equal(version) {
+		return preconditionFailed(c)
+	}
+	// The patch applies to the version read here, a concurrent change fails the update
+	version := book.UpdatedAt
+	original, err := json.Marshal(book)
+	if err != nil {
+		return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	var patched []byte
+	if strings.HasPrefix(c.ContentType(), jsonPatchContentType) {
+		var p jsonpatch.Patch
+		p, err = jsonpatch.DecodePatch(patch)
+		if err == nil {
+			patched, err = p.Apply(original)
+		}
+	} else {
+		patched, err = jsonpatch.MergePatch(original, patch)
+	}
+	if err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	book = &models.Book{}
+	if err = json.Unmarshal(patched, book); err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	// The ID can not be changed by a patch
+	book.Id = id
+	return bc.saveBook(c, book, version, "Book updated successfully")
+}
+
+// DeleteBook removes a book
+func (bc *BookController) DeleteBook(c okapi.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	book, err := bc.repo.Get(id)
+	if err != nil {
+		return bc.repositoryError(c, err)
+	}
+	if version, ok := ifMatch(c); !ok || !version.IsZero() && !book.UpdatedAt.Equal(version) {
+		return preconditionFailed(c)
+	}
+	// Deletes the version read here, which is returned
+	if err = bc.repo.Delete(id, book.UpdatedAt); err != nil {
+		return bc.repositoryError(c, err)
+	}
+	return c.OK(models.Response{
+		Success: true,
+		Message: "Book deleted successfully",
+		Data:    *book,
+	})
+}
+
+// saveBook updates the book, version is the UpdatedAt the stored book must still have, zero skips the check
+func (bc *BookController) saveBook(c okapi.Context, book *models.Book, version time.Time, message string) error {
+	if err := bc.repo.Update(book, version); err != nil {
+		return bc.repositoryError(c, err)
+	}
+	c.SetHeader("ETag", etag(book))
+	return c.OK(models.Response{
+		Success: true,
+		Message: message,
+		Data:    *book,
+	})
+}
+
+// repositoryError maps repository errors to HTTP responses
+func (bc *BookController) repositoryError(c okapi.Context, err error) error {
+	if errors.Is(err, repositories.ErrBookNotFound) {
+		return c.AbortNotFound("Book not found")
+	}
+	if errors.Is(err, repositories.ErrBookModified) {
+		if c.Header("If-Match") != "" {
+			return preconditionFailed(c)
 		}
+		return c.ErrorConflict(models.ErrorResponse{Success: false, Status: http.StatusConflict, Details: err.Error() + ", retry", RequestID: middlewares.GetRequestID(c)})
+	}
+	middlewares.Log(c).Error("Book repository error", "error", err)
+	return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+}
+
+// etag returns the entity tag of the book, it changes whenever the book is updated
+func etag(book *models.Book) string {
+	return `"` + strconv.FormatInt(book.UpdatedAt.UnixNano(), 10) + `"`
+}
+
+// ifMatch returns the version of the book required by the If-Match header, zero when any version is accepted.
+// ok is false when the header is not an entity tag returned by etag, no book can match it.
+func ifMatch(c okapi.Context) (version time.Time, ok bool) {
+	value := strings.TrimSpace(c.Header("If-Match"))
+	if value == "" || value == "*" {
+		return time.Time{}, true
+	}
+	nanos, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(value, `"`), `"`), 10, 64)
+	if err != nil || !strings.HasPrefix(value, `"`) || !strings.HasSuffix(value, `"`) || nanos == 0 {
+		return time.Time{}, false
 	}
-	return c.AbortNotFound("Book not found")
+	return time.Unix(0, nanos), true
+}
+
+func preconditionFailed(c okapi.Context) error {
+	return c.ErrorPreconditionFailed(models.ErrorResponse{Success: false, Status: http.StatusPreconditionFailed, Details: repositories.ErrBookModified.Error(), RequestID: middlewares.GetRequestID(c)})
 }
 
 // ******************** AuthController *****************
@@ -121,15 +384,58 @@ func (bc *AuthController) Login(c okapi.Context) error {
 	authRequest := &models.AuthRequest{}
 	err := c.Bind(authRequest)
 	if err != nil {
-		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error()})
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
 	}
 	// Validate the authRequest and generate a JWT token
-	authResponse, err := middlewares.Login(authRequest)
+	authResponse, err := middlewares.Login(middlewares.Log(c), bc.users, bc.refreshTokens, authRequest)
+	if err != nil {
+		middlewares.Log(c).Warn("Login failed", "username", authRequest.Username, "error", err)
+		return c.ErrorUnauthorized(authResponse)
+	}
+	return c.OK(authResponse)
+}
+
+// Refresh rotates a refresh token, returning a new access token and refresh token
+func (bc *AuthController) Refresh(c okapi.Context) error {
+	refreshRequest := &models.RefreshRequest{}
+	err := c.Bind(refreshRequest)
 	if err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	authResponse, err := middlewares.Refresh(middlewares.Log(c), bc.users, bc.refreshTokens, refreshRequest)
+	if err != nil {
+		if errors.Is(err, repositories.ErrRefreshTokenReused) {
+			middlewares.Log(c).Warn("Refresh token reused, token family revoked", "ip", middlewares.ClientIP(c, bc.config.Proxy))
+		} else {
+			middlewares.Log(c).Warn("Token refresh failed", "error", err)
+		}
 		return c.ErrorUnauthorized(authResponse)
 	}
 	return c.OK(authResponse)
 }
+
+// Logout revokes the JWT token used for the request and the given refresh token
+func (bc *AuthController) Logout(c okapi.Context) error {
+	logoutRequest := &models.LogoutRequest{}
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(logoutRequest); err != nil {
+			return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+		}
+	}
+	err := middlewares.Logout(bc.refreshTokens, bc.denylist, c.GetString("jti"), middlewares.TokenExpiry(c), logoutRequest.RefreshToken)
+	if err != nil {
+		middlewares.Log(c).Error("Logout failed", "username", c.GetString("username"), "error", err)
+		return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	middlewares.Log(c).Info("User logged out", "username", c.GetString("username"))
+	return c.OK(models.AuthResponse{Success: true, Message: "Logged out"})
+}
+
+// JWKS publishes the public keys tokens are signed with, so that other services can verify them
+func (bc *AuthController) JWKS(c okapi.Context) error {
+	c.SetHeader("Cache-Control", "public, max-age=300")
+	return c.OK(middlewares.Keys().JWKS())
+}
 func (bc *AuthController) WhoAmI(c okapi.Context) error {
 	//Get User Information from the context, shared by the JWT middleware using forwardClaims
 	email := c.GetString("email")
@@ -148,20 +454,3 @@ func (bc *AuthController) WhoAmI(c okapi.Context) error {
 	},
 	)
 }
-
-func (bc *BookController) readBooksFromFile() ([]*models.Book, error) {
-	if books != nil && len(books) > 3 {
-		return books, nil
-	}
-	booksFile, err := os.ReadFile("data/books.json")
-	if err != nil {
-		logger.Error("Error reading books file", "error", err)
-		return nil, fmt.Errorf("failed to read books data: %w", err)
-	}
-	err = json.Unmarshal(booksFile, &books)
-	if err != nil {
-		logger.Error("Error unmarshalling books data", "error", err)
-		return nil, fmt.Errorf("failed to parse books data: %w", err)
-	}
-	return books, nil
-}
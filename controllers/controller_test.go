@@ -0,0 +1,281 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jkaninda/okapi"
+	"github.com/jkaninda/okapi-example/models"
+	"github.com/jkaninda/okapi-example/repositories"
+)
+
+// fakeBookRepository serves fixed books and records the calls of the handlers
+type fakeBookRepository struct {
+	books map[int]models.Book
+	// err is returned by every call when set
+	err error
+
+	filter  repositories.BookFilter
+	updated []models.Book
+	deleted []int
+}
+
+func (r *fakeBookRepository) List() ([]*models.Book, error) {
+	books, _, err := r.Find(repositories.BookFilter{})
+	return books, err
+}
+
+func (r *fakeBookRepository) Find(filter repositories.BookFilter) ([]*models.Book, int, error) {
+	r.filter = filter
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	books := make([]*models.Book, 0, len(r.books))
+	for id := 1; id <= len(r.books); id++ {
+		book := r.books[id]
+		books = append(books, &book)
+	}
+	return books, len(books), nil
+}
+
+func (r *fakeBookRepository) Get(id int) (*models.Book, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	book, ok := r.books[id]
+	if !ok {
+		return nil, repositories.ErrBookNotFound
+	}
+	return &book, nil
+}
+
+func (r *fakeBookRepository) Create(*models.Book) error {
+	return errors.New("not implemented")
+}
+
+func (r *fakeBookRepository) Update(book *models.Book, version time.Time) error {
+	existing, err := r.Get(book.Id)
+	if err != nil {
+		return err
+	}
+	if !version.IsZero() && !existing.UpdatedAt.Equal(version) {
+		return repositories.ErrBookModified
+	}
+	book.UpdatedAt = existing.UpdatedAt.Add(time.Second)
+	r.updated = append(r.updated, *book)
+	return nil
+}
+
+func (r *fakeBookRepository) Delete(id int, _ time.Time) error {
+	if _, err := r.Get(id); err != nil {
+		return err
+	}
+	r.deleted = append(r.deleted, id)
+	return nil
+}
+
+func (r *fakeBookRepository) Count() (int, error) {
+	return len(r.books), r.err
+}
+
+// newBookServer serves the handlers of a BookController backed by repo
+func newBookServer(repo repositories.BookRepository) *okapi.Okapi {
+	bc := NewBookController(repo, nil)
+	app := okapi.New()
+	app.Get("/books", bc.GetBooks)
+	app.Get("/books/:id", bc.GetBook)
+	app.Put("/books/:id", bc.UpdateBook)
+	app.Patch("/books/:id", bc.PatchBook)
+	app.Delete("/books/:id", bc.DeleteBook)
+	return app
+}
+
+func serve(app *okapi.Okapi, method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, req)
+	return rec
+}
+
+func newFakeBooks() *fakeBookRepository {
+	updatedAt := time.Date(2025, 7, 25, 17, 31, 54, 239027000, time.UTC)
+	return &fakeBookRepository{books: map[int]models.Book{
+		1: {Id: 1, Title: "Things Fall Apart", Price: 100, Year: 1958, Author: "Chinua Achebe", UpdatedAt: updatedAt},
+		2: {Id: 2, Title: "Fairy tales", Price: 150, Year: 1836, Author: "Hans Christian Andersen", UpdatedAt: updatedAt},
+	}}
+}
+
+func TestGetBook(t *testing.T) {
+	repo := newFakeBooks()
+	app := newBookServer(repo)
+
+	rec := serve(app, http.MethodGet, "/books/1", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /books/1 status = %d, body %s", rec.Code, rec.Body)
+	}
+	var book models.Book
+	if err := json.Unmarshal(rec.Body.Bytes(), &book); err != nil {
+		t.Fatal(err)
+	}
+	if book.Id != 1 || book.Title != "Things Fall Apart" {
+		t.Errorf("GET /books/1 returned %+v", book)
+	}
+	if got, want := rec.Header().Get("ETag"), etag(&book); got != want {
+		t.Errorf("ETag = %q, want %q", got, want)
+	}
+
+	for target, status := range map[string]int{
+		"/books/3":   http.StatusNotFound,
+		"/books/abc": http.StatusBadRequest,
+	} {
+		if rec = serve(app, http.MethodGet, target, "", nil); rec.Code != status {
+			t.Errorf("GET %s status = %d, want %d", target, rec.Code, status)
+		}
+	}
+
+	repo.err = errors.New("storage unavailable")
+	if rec = serve(app, http.MethodGet, "/books/1", "", nil); rec.Code != http.StatusInternalServerError {
+		t.Errorf("GET /books/1 with a failing repository status = %d, want 500", rec.Code)
+	}
+}
+
+func TestGetBooksPagination(t *testing.T) {
+	repo := newFakeBooks()
+	app := newBookServer(repo)
+
+	rec := serve(app, http.MethodGet, "/books?page=3&pageSize=10&sort=-price", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /books status = %d, body %s", rec.Code, rec.Body)
+	}
+	if repo.filter.Offset != 20 || repo.filter.Limit != 10 {
+		t.Errorf("filter offset, limit = %d, %d, want 20, 10", repo.filter.Offset, repo.filter.Limit)
+	}
+	if len(repo.filter.Sort) != 1 || repo.filter.Sort[0].Field != "price" || !repo.filter.Sort[0].Desc {
+		t.Errorf("filter sort = %+v, want price descending", repo.filter.Sort)
+	}
+	var page models.BookPage
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 2 || page.TotalPages != 1 || page.Page != 3 {
+		t.Errorf("page total, totalPages, page = %d, %d, %d", page.Total, page.TotalPages, page.Page)
+	}
+
+	for _, query := range []string{
+		"page=0",
+		"pageSize=101",
+		"sort=unknown",
+		// The offset of the page would overflow
+		"page=9223372036854775807&pageSize=100",
+	} {
+		if rec = serve(app, http.MethodGet, "/books?"+query, "", nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("GET /books?%s status = %d, want 400", query, rec.Code)
+		}
+	}
+	// Values of a request body are checked too
+	if rec = serve(app, http.MethodGet, "/books", `{"page": -1}`, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("GET /books with a negative page in the body status = %d, want 400", rec.Code)
+	}
+}
+
+func TestUpdateBookPrecondition(t *testing.T) {
+	repo := newFakeBooks()
+	app := newBookServer(repo)
+	current := repo.books[1]
+	body := `{"title": "Things Fall Apart", "price": 120, "year": 1958, "author": "Chinua Achebe"}`
+
+	stale := etag(&models.Book{UpdatedAt: current.UpdatedAt.Add(-time.Second)})
+	for _, ifMatch := range []string{stale, "garbage"} {
+		rec := serve(app, http.MethodPut, "/books/1", body, map[string]string{"If-Match": ifMatch})
+		if rec.Code != http.StatusPreconditionFailed {
+			t.Errorf("PUT with If-Match %s status = %d, want 412", ifMatch, rec.Code)
+		}
+	}
+	if len(repo.updated) != 0 {
+		t.Fatalf("book updated despite a failed precondition: %+v", repo.updated)
+	}
+
+	rec := serve(app, http.MethodPut, "/books/1", body, map[string]string{"If-Match": etag(&current)})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT with the current ETag status = %d, body %s", rec.Code, rec.Body)
+	}
+	if len(repo.updated) != 1 || repo.updated[0].Id != 1 || repo.updated[0].Price != 120 {
+		t.Errorf("updated books = %+v", repo.updated)
+	}
+	if got, want := rec.Header().Get("ETag"), etag(&repo.updated[0]); got != want {
+		t.Errorf("ETag after update = %q, want %q", got, want)
+	}
+}
+
+func TestPatchBook(t *testing.T) {
+	repo := newFakeBooks()
+	app := newBookServer(repo)
+
+	rec := serve(app, http.MethodPatch, "/books/2", `{"price": 99, "id": 7}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH /books/2 status = %d, body %s", rec.Code, rec.Body)
+	}
+	if len(repo.updated) != 1 {
+		t.Fatalf("updated books = %+v", repo.updated)
+	}
+	// The patch is merged into the stored book, whose ID can not change
+	if got := repo.updated[0]; got.Id != 2 || got.Price != 99 || got.Title != "Fairy tales" {
+		t.Errorf("patched book = %+v", got)
+	}
+
+	rec = serve(app, http.MethodPatch, "/books/2", `{"price": 98}`, map[string]string{"If-Match": `"1"`})
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("PATCH with a stale ETag status = %d, want 412", rec.Code)
+	}
+}
+
+func TestDeleteBook(t *testing.T) {
+	repo := newFakeBooks()
+	app := newBookServer(repo)
+
+	if rec := serve(app, http.MethodDelete, "/books/3", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE /books/3 status = %d, want 404", rec.Code)
+	}
+	rec := serve(app, http.MethodDelete, "/books/1", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("DELETE /books/1 status = %d, body %s", rec.Code, rec.Body)
+	}
+	if len(repo.deleted) != 1 || repo.deleted[0] != 1 {
+		t.Errorf("deleted books = %v, want [1]", repo.deleted)
+	}
+}
@@ -0,0 +1,229 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package controllers
+
+import (
+	"errors"
+	"github.com/jkaninda/okapi"
+	"github.com/jkaninda/okapi-example/middlewares"
+	"github.com/jkaninda/okapi-example/models"
+	"github.com/jkaninda/okapi-example/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// recoveryCodeCount is the number of recovery codes generated when two-factor authentication is enabled
+const recoveryCodeCount = 10
+
+var (
+	// errMFADisabled is returned when managing two-factor authentication of a user who has not enabled it
+	errMFADisabled = errors.New("two-factor authentication is not enabled")
+	// errMFAEnabled is returned when enrolling a user who has already enabled two-factor authentication
+	errMFAEnabled = errors.New("two-factor authentication is already enabled")
+	// errMFANotEnrolled is returned when confirming two-factor authentication before enrolling
+	errMFANotEnrolled = errors.New("two-factor authentication enrollment has not been started")
+)
+
+// ******************** Two-factor authentication *****************
+
+// EnrollTOTP generates a TOTP secret for the authenticated user.
+// Two-factor authentication is enabled by ConfirmTOTP, once the authenticator app has been set up.
+func (bc *AuthController) EnrollTOTP(c okapi.Context) error {
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	user, err := bc.users.Update(c.GetString("username"), func(user *models.User) error {
+		if user.TOTPEnabled {
+			return errMFAEnabled
+		}
+		user.TOTPSecret = secret
+		return nil
+	})
+	if err != nil {
+		return bc.mfaError(c, err)
+	}
+	return c.OK(models.TOTPEnrollment{
+		Secret: user.TOTPSecret,
+		URI:    utils.TOTPProvisioningURI(bc.config.JWT.Issuer, user.Username, user.TOTPSecret),
+	})
+}
+
+// ConfirmTOTP enables two-factor authentication with the first code of the authenticator app,
+// and returns the recovery codes
+func (bc *AuthController) ConfirmTOTP(c okapi.Context) error {
+	req := &models.TOTPCodeRequest{}
+	if err := c.Bind(req); err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	user, err := bc.users.Update(c.GetString("username"), func(user *models.User) error {
+		if user.TOTPEnabled {
+			return errMFAEnabled
+		}
+		if user.TOTPSecret == "" {
+			return errMFANotEnrolled
+		}
+		step, ok := utils.VerifyTOTP(user.TOTPSecret, req.Code, time.Now(), user.TOTPLastStep)
+		if !ok {
+			return middlewares.ErrOTPInvalid
+		}
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		user.RecoveryCodes = hashes
+		return nil
+	})
+	if errors.Is(err, middlewares.ErrOTPInvalid) {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	if err != nil {
+		return bc.mfaError(c, err)
+	}
+	middlewares.Log(c).Info("Two-factor authentication enabled", "username", user.Username)
+	return c.OK(codes)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the authenticated user, the previous ones stop working
+func (bc *AuthController) RegenerateRecoveryCodes(c okapi.Context) error {
+	req := &models.TOTPCodeRequest{}
+	if err := c.Bind(req); err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	user, err := bc.verifiedUser(c, req.Code)
+	if err != nil {
+		return bc.mfaError(c, err)
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	user, err = bc.users.Update(user.Username, func(user *models.User) error {
+		// Disabled by another request since the code was verified
+		if !user.TOTPEnabled {
+			return errMFADisabled
+		}
+		user.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		return bc.mfaError(c, err)
+	}
+	middlewares.Log(c).Info("Recovery codes regenerated", "username", user.Username)
+	return c.OK(codes)
+}
+
+// DisableTOTP turns off two-factor authentication of the authenticated user, a TOTP or recovery code is required
+func (bc *AuthController) DisableTOTP(c okapi.Context) error {
+	req := &models.TOTPCodeRequest{}
+	if err := c.Bind(req); err != nil {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	user, err := bc.verifiedUser(c, req.Code)
+	if err != nil {
+		return bc.mfaError(c, err)
+	}
+	if user, err = bc.clearTOTP(c, user.Username); err != nil {
+		return bc.userStoreError(c, err)
+	}
+	return c.OK(userInfo(user))
+}
+
+// ResetMFA turns off two-factor authentication of a user who lost their authenticator app and recovery codes
+func (bc *AuthController) ResetMFA(c okapi.Context) error {
+	user, err := bc.clearTOTP(c, c.Param("username"))
+	if err != nil {
+		return bc.userStoreError(c, err)
+	}
+	middlewares.Log(c).Warn("Two-factor authentication reset", "username", user.Username, "by", c.GetString("username"))
+	return c.OK(userInfo(user))
+}
+
+// verifiedUser loads the authenticated user and checks their TOTP or recovery code
+func (bc *AuthController) verifiedUser(c okapi.Context, code string) (*models.User, error) {
+	user, err := bc.currentUser(c)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TOTPEnabled {
+		return nil, errMFADisabled
+	}
+	if err = bc.loginGuard.VerifyOTP(c, bc.users, user, code); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// mfaError maps the errors of verifiedUser to HTTP responses
+func (bc *AuthController) mfaError(c okapi.Context, err error) error {
+	var blocked *middlewares.OTPBlockedError
+	switch {
+	case errors.As(err, &blocked):
+		c.SetHeader("Retry-After", strconv.Itoa(blocked.RetryAfter))
+		return c.ErrorTooManyRequests(models.ErrorResponse{Success: false, Status: http.StatusTooManyRequests, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	case errors.Is(err, errMFAEnabled):
+		return c.ErrorConflict(models.ErrorResponse{Success: false, Status: http.StatusConflict, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	case errors.Is(err, errMFADisabled), errors.Is(err, errMFANotEnrolled), errors.Is(err, middlewares.ErrOTPRequired):
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	case errors.Is(err, middlewares.ErrOTPInvalid):
+		return c.ErrorForbidden(models.ErrorResponse{Success: false, Status: http.StatusForbidden, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	return bc.userStoreError(c, err)
+}
+
+// newRecoveryCodes generates recovery codes and the hashes stored in place of the codes
+func newRecoveryCodes() (models.RecoveryCodes, []string, error) {
+	codes, err := utils.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return models.RecoveryCodes{}, nil, err
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, utils.HashRecoveryCode(code))
+	}
+	return models.RecoveryCodes{RecoveryCodes: codes}, hashes, nil
+}
+
+// clearTOTP turns off two-factor authentication, sessions opened with it can no longer be refreshed
+func (bc *AuthController) clearTOTP(c okapi.Context, username string) (*models.User, error) {
+	user, err := bc.users.Update(username, func(user *models.User) error {
+		user.TOTPEnabled = false
+		user.TOTPSecret = ""
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = bc.refreshTokens.RevokeUser(user.Username); err != nil {
+		middlewares.Log(c).Error("Failed to revoke refresh tokens", "username", user.Username, "error", err)
+	}
+	middlewares.Log(c).Info("Two-factor authentication disabled", "username", user.Username)
+	return user, nil
+}
@@ -0,0 +1,159 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package controllers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/jkaninda/okapi"
+	"github.com/jkaninda/okapi-example/middlewares"
+	"github.com/jkaninda/okapi-example/models"
+	"github.com/jkaninda/okapi-example/oidc"
+	"github.com/jkaninda/okapi-example/repositories"
+	"net/http"
+	"strings"
+)
+
+// oidcStateCookie binds a login to the browser that started it, so that an attacker can not
+// get a victim to complete a login the attacker started, i.e. log them in as the attacker
+const oidcStateCookie = "oidc_state"
+
+// ******************** OpenID Connect *****************
+
+// EnableOIDC delegates logins to an OpenID Connect provider, in addition to local passwords
+func (bc *AuthController) EnableOIDC(provider *oidc.Provider) {
+	bc.oidc = provider
+}
+
+// OIDCLogin redirects to the provider, starting an authorization code flow with PKCE
+func (bc *AuthController) OIDCLogin(c okapi.Context) error {
+	authURL, state, err := bc.oidc.AuthCodeURL()
+	if err != nil {
+		if errors.Is(err, oidc.ErrTooManyLogins) {
+			middlewares.Log(c).Warn("OIDC login rejected", "ip", middlewares.ClientIP(c, bc.config.Proxy), "error", err)
+			return c.ErrorServiceUnavailable(models.ErrorResponse{Success: false, Status: http.StatusServiceUnavailable, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+		}
+		return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	bc.setOIDCStateCookie(c, state, int(oidc.LoginTimeout.Seconds()))
+	c.Redirect(http.StatusFound, authURL)
+	return nil
+}
+
+// setOIDCStateCookie sets the state cookie, a negative maxAge deletes it.
+// SameSite=Lax, as the callback is a cross-site navigation from the provider.
+func (bc *AuthController) setOIDCStateCookie(c okapi.Context, state string, maxAge int) {
+	http.SetCookie(c.ResponseWriter(), &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/auth/oidc",
+		MaxAge:   maxAge,
+		Secure:   strings.HasPrefix(bc.config.OIDC.RedirectURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// OIDCCallback completes a login at the provider, provisioning the local user on their first login
+func (bc *AuthController) OIDCCallback(c okapi.Context) error {
+	if reason := c.Query("error"); reason != "" {
+		middlewares.Log(c).Warn("OIDC login denied by the provider", "error", reason, "description", c.Query("error_description"))
+		return c.ErrorUnauthorized(models.ErrorResponse{Success: false, Status: http.StatusUnauthorized, Details: "login denied by the identity provider: " + reason, RequestID: middlewares.GetRequestID(c)})
+	}
+	state, code := c.Query("state"), c.Query("code")
+	if state == "" || code == "" {
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: "state and code are required", RequestID: middlewares.GetRequestID(c)})
+	}
+	// The login must have been started by this browser, the state is left pending otherwise
+	cookie, err := c.Request().Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		middlewares.Log(c).Warn("OIDC login failed", "ip", middlewares.ClientIP(c, bc.config.Proxy), "error", "state does not match the login cookie")
+		return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: oidc.ErrInvalidState.Error(), RequestID: middlewares.GetRequestID(c)})
+	}
+	bc.setOIDCStateCookie(c, "", -1)
+	identity, err := bc.oidc.Exchange(c.Request().Context(), state, code)
+	if err != nil {
+		middlewares.Log(c).Warn("OIDC login failed", "ip", middlewares.ClientIP(c, bc.config.Proxy), "error", err)
+		switch {
+		case errors.Is(err, oidc.ErrInvalidState):
+			return c.ErrorBadRequest(models.ErrorResponse{Success: false, Status: http.StatusBadRequest, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+		case errors.Is(err, oidc.ErrEmailNotVerified):
+			return c.ErrorForbidden(models.ErrorResponse{Success: false, Status: http.StatusForbidden, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+		}
+		return c.ErrorUnauthorized(models.ErrorResponse{Success: false, Status: http.StatusUnauthorized, Details: "login at the identity provider failed", RequestID: middlewares.GetRequestID(c)})
+	}
+	user, err := bc.oidcUser(c, identity)
+	if err != nil {
+		if errors.Is(err, repositories.ErrUserDisabled) {
+			middlewares.Log(c).Warn("OIDC login failed", "username", identity.Username(), "error", err)
+			return c.ErrorForbidden(models.ErrorResponse{Success: false, Status: http.StatusForbidden, Details: err.Error(), RequestID: middlewares.GetRequestID(c)})
+		}
+		return bc.userStoreError(c, err)
+	}
+	authResponse, err := middlewares.LoginExternal(middlewares.Log(c), bc.refreshTokens, user, identity.AMR)
+	if err != nil {
+		middlewares.Log(c).Error("OIDC login failed", "username", user.Username, "error", err)
+		return c.ErrorInternalServerError(authResponse)
+	}
+	return c.OK(authResponse)
+}
+
+// oidcUser returns the local user of the identity, creating it on the first login.
+// The provider is authoritative, the profile and role are updated from its claims on every login.
+func (bc *AuthController) oidcUser(c okapi.Context, identity *oidc.Identity) (*models.User, error) {
+	policy := middlewares.Policy()
+	user, err := bc.users.Get(identity.Username())
+	if errors.Is(err, repositories.ErrUserNotFound) {
+		// No password hash, the user can only log in through the provider
+		user = &models.User{
+			Username: identity.Username(),
+			Name:     identity.Name,
+			Email:    identity.Email,
+			// Verified by the provider, see oidc.ErrEmailNotVerified
+			EmailVerified: true,
+			Role:          identity.Role,
+			Permissions:   policy.Permissions(identity.Role),
+		}
+		if err = bc.users.Create(user); err != nil {
+			return nil, err
+		}
+		middlewares.Log(c).Info("User provisioned from OIDC provider", "username", user.Username, "subject", identity.Subject, "role", user.Role)
+		return user, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bc.users.Update(user.Username, func(user *models.User) error {
+		if user.Disabled {
+			return repositories.ErrUserDisabled
+		}
+		user.Name = identity.Name
+		user.Email = identity.Email
+		user.EmailVerified = true
+		user.Role = identity.Role
+		user.Permissions = policy.Permissions(identity.Role)
+		return nil
+	})
+}
@@ -1,21 +1,37 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"github.com/jkaninda/logger"
 	"github.com/jkaninda/okapi"
+	"github.com/jkaninda/okapi-example/config"
 	"github.com/jkaninda/okapi-example/routes"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	// Create a new Okapi instance with default config
-	app := okapi.New()
-	route := routes.NewRoute(app)
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		logger.Fatal("Error loading configuration", "error", err)
+	}
+	// Create a new Okapi instance
+	app := okapi.New(okapi.WithPort(cfg.Server.Port))
+	route := routes.NewRoute(app, cfg)
 
 	// ************ Registering Routes ************
 	// Register home route
 	app.Register(route.Home())
 	app.Register(route.WhoAmI())
+	app.Register(route.JWKS())
 	// Auth
-	app.Register(route.AuthRoute())
+	app.Register(route.AuthRoutes()...)
 	// Register book routes
 	app.Register(route.BookRoutes()...)
 	app.Register(route.APIBookRoutes()...)
@@ -24,7 +40,21 @@ func main() {
 	app.Register(route.AdminRoutes()...)
 
 	// Start the server
-	if err := app.Start(); err != nil {
-		panic(err)
+	go func() {
+		if err := app.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	// Wait for a termination signal, then shut down gracefully
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+	if err := app.Stop(); err != nil {
+		logger.Error("Error stopping server", "error", err)
+	}
+	// Flush and close the book storage
+	if err := route.Close(); err != nil {
+		logger.Error("Error closing routes", "error", err)
 	}
 }
@@ -0,0 +1,124 @@
+package middlewares
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jkaninda/okapi"
+	"github.com/jkaninda/okapi-example/config"
+)
+
+// Reasons an admin token is rejected, returned by AdminClaims.Validate and sent to the client
+var (
+	ErrIPNotAllowed = errors.New("admin routes are not allowed from this address")
+	ErrTokenTooOld  = errors.New("token is too old for admin routes, log in again")
+	ErrMFARequired  = errors.New("multi-factor authentication is required for admin routes")
+)
+
+// AdminClaims validates the tokens of the admin routes, it is the ValidateClaims function of AdminJWTAuth
+type AdminClaims struct {
+	// MaxAge is the maximum time since the login, the `auth_time` claim, 0 disables the check
+	MaxAge time.Duration
+	// RequireMFA rejects tokens whose `amr` claim lacks AMRMFA
+	RequireMFA bool
+	// Networks the client address must belong to, any address is allowed when empty
+	Networks []netip.Prefix
+	// Proxy locates the client address
+	Proxy config.ProxyConfig
+}
+
+// NewAdminClaims creates the validator of admin tokens from the configuration
+func NewAdminClaims(cfg config.AdminConfig, proxy config.ProxyConfig) (*AdminClaims, error) {
+	networks, err := cfg.Networks()
+	if err != nil {
+		return nil, err
+	}
+	return &AdminClaims{
+		MaxAge:     cfg.MaxTokenAge,
+		RequireMFA: cfg.RequireMFA,
+		Networks:   networks,
+		Proxy:      proxy,
+	}, nil
+}
+
+// Validate checks the client address, then the time since the login, then the authentication methods of the token.
+// Errors wrap one of ErrIPNotAllowed, ErrTokenTooOld or ErrMFARequired.
+func (v *AdminClaims) Validate(c okapi.Context, claims jwt.Claims) error {
+	if err := v.ValidateClient(c); err != nil {
+		return err
+	}
+	if v.MaxAge > 0 {
+		// Unlike iat, auth_time is not renewed when the token is refreshed
+		authTime, ok := authTime(claims)
+		if !ok {
+			return fmt.Errorf("%w: missing auth_time claim", ErrTokenTooOld)
+		}
+		if age := time.Since(authTime); age > v.MaxAge {
+			return fmt.Errorf("%w: logged in %s ago, at most %s allowed", ErrTokenTooOld, age.Round(time.Second), v.MaxAge)
+		}
+	}
+	if v.RequireMFA && !slices.Contains(amr(claims), AMRMFA) {
+		return ErrMFARequired
+	}
+	return nil
+}
+
+// ValidateClient checks that the client address is allowed, it also applies to API keys on admin routes
+func (v *AdminClaims) ValidateClient(c okapi.Context) error {
+	if len(v.Networks) == 0 {
+		return nil
+	}
+	ip := ClientIP(c, v.Proxy)
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !slices.ContainsFunc(v.Networks, func(n netip.Prefix) bool { return n.Contains(addr.Unmap()) }) {
+		return fmt.Errorf("%w: %s", ErrIPNotAllowed, ip)
+	}
+	return nil
+}
+
+// ClientIP returns the address of the client, the proxy headers are only read when the proxy config trusts them.
+// Use it instead of RealIP, which trusts headers any client can set.
+func ClientIP(c okapi.Context, proxy config.ProxyConfig) string {
+	if proxy.TrustHeaders {
+		return c.RealIP()
+	}
+	host, _, err := net.SplitHostPort(c.Request().RemoteAddr)
+	if err != nil {
+		return c.Request().RemoteAddr
+	}
+	return host
+}
+
+// amr returns the authentication methods of the `amr` claim
+func amr(claims jwt.Claims) []string {
+	mapClaims, ok := claims.(jwt.MapClaims)
+	if !ok {
+		return nil
+	}
+	values, _ := mapClaims["amr"].([]any)
+	methods := make([]string, 0, len(values))
+	for _, value := range values {
+		if method, ok := value.(string); ok {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// authTime returns the time of the login, from the `auth_time` claim
+func authTime(claims jwt.Claims) (time.Time, bool) {
+	mapClaims, ok := claims.(jwt.MapClaims)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, ok := mapClaims["auth_time"].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
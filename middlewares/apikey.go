@@ -0,0 +1,150 @@
+package middlewares
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jkaninda/okapi"
+	"github.com/jkaninda/okapi-example/config"
+	"github.com/jkaninda/okapi-example/models"
+	"github.com/jkaninda/okapi-example/repositories"
+)
+
+const (
+	// APIKeyHeader is the header services send their API key in
+	APIKeyHeader = "X-API-Key"
+	// apiKeyPrefix starts every API key, so that leaked keys are easy to recognize
+	apiKeyPrefix = "okapi_"
+)
+
+var (
+	// APIKeyAuth authenticates services on the core routes, its store is set by ConfigureAPIKeys
+	APIKeyAuth = &KeyAuth{}
+	// AdminAPIKeyAuth authenticates services on the admin routes, ConfigureAdmin restricts their address
+	AdminAPIKeyAuth = &KeyAuth{}
+
+	errAPIKeyInvalid = errors.New("invalid API key")
+	errAPIKeyRevoked = errors.New("API key is revoked")
+	errAPIKeyExpired = errors.New("API key is expired")
+)
+
+// KeyAuth authenticates requests with an API key in the X-API-Key header.
+// The request is granted the permissions of the key, checked by RequirePermission like those of a role.
+type KeyAuth struct {
+	Keys repositories.APIKeyStore
+	// Proxy tells whether the client address of rejected requests is read from the proxy headers
+	Proxy config.ProxyConfig
+	// ValidateClient is called for valid keys, an error rejects the request with a 403 whose details are the error
+	ValidateClient func(c okapi.Context) error
+}
+
+// ConfigureAPIKeys sets the store API keys are checked against
+func ConfigureAPIKeys(keys repositories.APIKeyStore, proxy config.ProxyConfig) {
+	APIKeyAuth.Keys, APIKeyAuth.Proxy = keys, proxy
+	AdminAPIKeyAuth.Keys, AdminAPIKeyAuth.Proxy = keys, proxy
+}
+
+func (a *KeyAuth) Middleware(next okapi.HandleFunc) okapi.HandleFunc {
+	return func(c okapi.Context) error {
+		key, err := a.authenticate(c.Header(APIKeyHeader))
+		if err != nil {
+			Log(c).Warn("API key rejected", "ip", ClientIP(c, a.Proxy), "error", err)
+			return c.AbortUnauthorized("Invalid or expired API key", err)
+		}
+		if a.ValidateClient != nil {
+			if err = a.ValidateClient(c); err != nil {
+				Log(c).Warn("Failed to validate API key client", "id", key.ID, "error", err)
+				return c.ErrorForbidden(models.ErrorResponse{Success: false, Status: http.StatusForbidden, Details: err.Error(), RequestID: GetRequestID(c)})
+			}
+		}
+		if err = a.Keys.Touch(key.ID, time.Now()); err != nil {
+			Log(c).Error("Failed to record API key use", "id", key.ID, "error", err)
+		}
+		// Keys act on behalf of no user, the username can not collide with a real one
+		c.Set("username", "apikey:"+key.ID)
+		c.Set("api_key", key.ID)
+		c.Set("permissions", key.Permissions)
+		return next(c)
+	}
+}
+
+// Or authenticates requests sending the X-API-Key header with their key, and the other requests with bearer
+func (a *KeyAuth) Or(bearer okapi.Middleware) okapi.Middleware {
+	return func(next okapi.HandleFunc) okapi.HandleFunc {
+		withKey, withBearer := a.Middleware(next), bearer(next)
+		return func(c okapi.Context) error {
+			if c.Header(APIKeyHeader) != "" {
+				return withKey(c)
+			}
+			return withBearer(c)
+		}
+	}
+}
+
+// authenticate returns the stored key matching the raw key, formatted as okapi_<id>_<secret>
+func (a *KeyAuth) authenticate(raw string) (*models.APIKey, error) {
+	rest, ok := strings.CutPrefix(raw, apiKeyPrefix)
+	if !ok {
+		return nil, errAPIKeyInvalid
+	}
+	id, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, errAPIKeyInvalid
+	}
+	key, err := a.Keys.Get(id)
+	if err != nil {
+		if errors.Is(err, repositories.ErrAPIKeyNotFound) {
+			return nil, errAPIKeyInvalid
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(raw)), []byte(key.Hash)) != 1 {
+		return nil, errAPIKeyInvalid
+	}
+	if key.Revoked {
+		return nil, fmt.Errorf("%w: %s", errAPIKeyRevoked, key.ID)
+	}
+	if !key.ExpiresAt.IsZero() && time.Now().After(key.ExpiresAt) {
+		return nil, fmt.Errorf("%w: %s", errAPIKeyExpired, key.ID)
+	}
+	return key, nil
+}
+
+// NewAPIKey generates an API key granted the permissions, it expires after ttl unless ttl is 0.
+// The raw key is returned once, only its hash is kept in the returned APIKey.
+func NewAPIKey(name string, permissions []string, createdBy string, ttl time.Duration) (string, *models.APIKey, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, fmt.Errorf("failed to generate API key: %w", err)
+	}
+	secret, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	id := hex.EncodeToString(b)
+	raw := apiKeyPrefix + id + "_" + secret
+	key := &models.APIKey{
+		ID:          id,
+		Name:        name,
+		Hash:        hashToken(raw),
+		Permissions: slices.Clone(permissions),
+		CreatedBy:   createdBy,
+		CreatedAt:   time.Now(),
+	}
+	if ttl > 0 {
+		key.ExpiresAt = key.CreatedAt.Add(ttl)
+	}
+	return raw, key, nil
+}
+
+// APIKeyPrefix returns the start of the keys with the given ID, enough to recognize a key
+func APIKeyPrefix(id string) string {
+	return apiKeyPrefix + id
+}
@@ -0,0 +1,113 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jkaninda/okapi"
+	"github.com/jkaninda/okapi-example/models"
+	"github.com/jkaninda/okapi-example/rbac"
+	"github.com/jkaninda/okapi-example/repositories"
+)
+
+// newAPIKey stores a key granted the permissions and returns its raw value
+func newAPIKey(t *testing.T, keys repositories.APIKeyStore, ttl time.Duration, permissions ...string) (string, *models.APIKey) {
+	t.Helper()
+	raw, key, err := NewAPIKey("test", permissions, "admin", ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = keys.Create(key); err != nil {
+		t.Fatal(err)
+	}
+	return raw, key
+}
+
+func TestKeyAuth(t *testing.T) {
+	keys := repositories.NewInMemoryAPIKeyStore()
+	auth := &KeyAuth{Keys: keys}
+	reader, readerKey := newAPIKey(t, keys, 0, rbac.BooksRead)
+	writer, _ := newAPIKey(t, keys, time.Hour, "books:*")
+	revoked, revokedKey := newAPIKey(t, keys, 0, rbac.BooksRead)
+	if err := keys.Revoke(revokedKey.ID); err != nil {
+		t.Fatal(err)
+	}
+	expired, expiredKey := newAPIKey(t, keys, time.Hour, rbac.BooksRead)
+	expiredKey.ExpiresAt = time.Now().Add(-time.Second)
+	if err := keys.Create(expiredKey); err != nil {
+		t.Fatal(err)
+	}
+	id, secret, _ := strings.Cut(strings.TrimPrefix(reader, apiKeyPrefix), "_")
+
+	app := okapi.New()
+	handler := func(c okapi.Context) error { return c.OK(c.GetString("api_key")) }
+	app.Get("/read", auth.Middleware(RequirePermission(rbac.BooksRead)(handler)))
+	app.Delete("/delete", auth.Middleware(RequirePermission(rbac.BooksDelete)(handler)))
+
+	for _, tc := range []struct {
+		name, method, path, key string
+		status                  int
+	}{
+		{"granted permission", http.MethodGet, "/read", reader, http.StatusOK},
+		{"permission outside the key scope", http.MethodDelete, "/delete", reader, http.StatusForbidden},
+		{"wildcard permission", http.MethodDelete, "/delete", writer, http.StatusOK},
+		{"missing key", http.MethodGet, "/read", "", http.StatusUnauthorized},
+		{"missing prefix", http.MethodGet, "/read", strings.TrimPrefix(reader, apiKeyPrefix), http.StatusUnauthorized},
+		{"missing secret", http.MethodGet, "/read", apiKeyPrefix + id, http.StatusUnauthorized},
+		{"wrong secret", http.MethodGet, "/read", apiKeyPrefix + id + "_" + strings.Repeat("x", len(secret)), http.StatusUnauthorized},
+		{"unknown ID", http.MethodGet, "/read", apiKeyPrefix + "0000000000000000_" + secret, http.StatusUnauthorized},
+		{"secret of another key", http.MethodGet, "/read", apiKeyPrefix + revokedKey.ID + "_" + secret, http.StatusUnauthorized},
+		{"revoked key", http.MethodGet, "/read", revoked, http.StatusUnauthorized},
+		{"expired key", http.MethodGet, "/read", expired, http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.key != "" {
+			req.Header.Set(APIKeyHeader, tc.key)
+		}
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s: %s %s status = %d, want %d", tc.name, tc.method, tc.path, rec.Code, tc.status)
+		}
+	}
+
+	key, err := keys.Get(readerKey.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.LastUsedAt.IsZero() {
+		t.Error("the use of the key was not recorded")
+	}
+}
+
+func TestNewAPIKey(t *testing.T) {
+	permissions := []string{rbac.BooksRead}
+	raw, key, err := NewAPIKey("import", permissions, "admin", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(raw, APIKeyPrefix(key.ID)+"_") {
+		t.Errorf("key %q does not start with %q", raw, APIKeyPrefix(key.ID)+"_")
+	}
+	if key.Hash == "" || strings.Contains(key.Hash, raw) || key.Hash != hashToken(raw) {
+		t.Error("the stored key is not the hash of the raw key")
+	}
+	if !key.ExpiresAt.IsZero() {
+		t.Errorf("ExpiresAt = %v, want zero for a key without lifetime", key.ExpiresAt)
+	}
+	// The key does not share the permissions of the caller
+	permissions[0] = rbac.UsersAdmin
+	if key.Permissions[0] != rbac.BooksRead {
+		t.Errorf("key permissions changed with the caller's slice: %v", key.Permissions)
+	}
+	other, _, err := NewAPIKey("import", nil, "admin", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == raw {
+		t.Error("two keys are equal")
+	}
+}
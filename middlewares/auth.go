@@ -0,0 +1,110 @@
+package middlewares
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jkaninda/okapi"
+	"github.com/jkaninda/okapi-example/models"
+)
+
+// TokenAuth authenticates requests with a bearer JWT verified against a Keyring.
+// It mirrors okapi.JWTAuth, which can not select keys by `kid` nor verify Ed25519 signatures.
+type TokenAuth struct {
+	// Keys selects the verification key of a token by its `kid` header
+	Keys     *Keyring
+	Audience string
+	Issuer   string
+	// ClaimsExpression is evaluated against the claims, see okapi.ParseExpression
+	ClaimsExpression string
+	// ForwardClaims maps context keys to claim paths, nested claims use dot notation
+	ForwardClaims map[string]string
+	// ValidateClaims is called with the claims of valid tokens, an error rejects the request with a 403 whose details are the error
+	ValidateClaims func(c okapi.Context, claims jwt.Claims) error
+
+	once       sync.Once
+	expression okapi.Expression
+	exprErr    error
+}
+
+func (a *TokenAuth) Middleware(next okapi.HandleFunc) okapi.HandleFunc {
+	return func(c okapi.Context) error {
+		tokenStr := strings.TrimPrefix(c.Header("Authorization"), "Bearer ")
+		if tokenStr == "" {
+			return c.AbortUnauthorized("Missing or invalid token")
+		}
+		claims := jwt.MapClaims{}
+		token, err := jwt.ParseWithClaims(tokenStr, claims, a.Keys.Keyfunc,
+			jwt.WithValidMethods(a.Keys.Methods()),
+			jwt.WithAudience(a.Audience),
+			jwt.WithIssuer(a.Issuer),
+			jwt.WithExpirationRequired())
+		if err != nil || !token.Valid {
+			return c.AbortUnauthorized("Invalid or expired token", err)
+		}
+		if a.ClaimsExpression != "" {
+			valid, err := a.evaluate(claims)
+			if err != nil {
+				Log(c).Warn("Failed to validate JWT claims expression", "error", err)
+				return c.AbortUnauthorized("failed to validate authentication permissions", err)
+			}
+			if !valid {
+				return c.ErrorForbidden(models.ErrorResponse{Success: false, Status: http.StatusForbidden, Details: "Insufficient permissions", RequestID: GetRequestID(c)})
+			}
+		}
+		if a.ValidateClaims != nil {
+			if err = a.ValidateClaims(c, claims); err != nil {
+				Log(c).Warn("Failed to validate JWT claims", "function", "ValidateClaims", "subject", claimValue(claims, "sub"), "error", err)
+				// The error tells the client why the token is rejected, e.g. that it must log in again
+				return c.ErrorForbidden(models.ErrorResponse{Success: false, Status: http.StatusForbidden, Details: err.Error(), RequestID: GetRequestID(c)})
+			}
+		}
+		for key, path := range a.ForwardClaims {
+			if value := claimValue(claims, path); value != "" {
+				c.Set(key, value)
+			}
+		}
+		return next(c)
+	}
+}
+
+func (a *TokenAuth) evaluate(claims jwt.MapClaims) (bool, error) {
+	a.once.Do(func() {
+		a.expression, a.exprErr = okapi.ParseExpression(a.ClaimsExpression)
+	})
+	if a.exprErr != nil {
+		return false, fmt.Errorf("failed to parse claims expression: %w", a.exprErr)
+	}
+	return a.expression.Evaluate(claims)
+}
+
+// claimValue returns the claim at path formatted as a string, or an empty string when it is missing
+func claimValue(claims jwt.MapClaims, path string) string {
+	var current any = map[string]any(claims)
+	for _, key := range strings.Split(path, ".") {
+		m, ok := current.(map[string]any)
+		if !ok {
+			return ""
+		}
+		if current, ok = m[key]; !ok {
+			return ""
+		}
+	}
+	switch v := current.(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprintf("%.0f", v)
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return strings.Join(values, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,68 @@
+package middlewares
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jkaninda/okapi-example/models"
+)
+
+// Authentication methods of the `amr` claim, see RFC 8176
+const (
+	AMRPassword = "pwd"
+	AMRMFA      = "mfa"
+)
+
+// UserClaims holds the profile of the user a token is issued to
+type UserClaims struct {
+	Name  string `json:"name"`
+	Role  string `json:"role"`
+	Email string `json:"email"`
+}
+
+// Claims are the claims of the access tokens signed by Login
+type Claims struct {
+	User          UserClaims `json:"user"`
+	EmailVerified bool       `json:"email_verified"`
+	Permissions   []string   `json:"permissions"`
+	// AMR lists the authentication methods used to log in, as defined by RFC 8176
+	AMR []string `json:"amr"`
+	// AuthTime is the time of the login, refreshed tokens keep the time of the original login
+	AuthTime *jwt.NumericDate `json:"auth_time"`
+	jwt.RegisteredClaims
+}
+
+// NewClaims builds the claims of a new access token for the user, valid for ttl from now.
+// Every call returns fresh values with a unique token ID, nothing is shared between logins.
+func NewClaims(user *models.User, ttl time.Duration) (*Claims, error) {
+	jti, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &Claims{
+		User: UserClaims{
+			Name:  user.Name,
+			Role:  user.Role,
+			Email: user.Email,
+		},
+		EmailVerified: user.EmailVerified,
+		Permissions:   append([]string{}, user.Permissions...),
+		AMR:           []string{AMRPassword},
+		AuthTime:      jwt.NewNumericDate(now),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   user.Username,
+			Issuer:    tokenConfig.Issuer,
+			Audience:  jwt.ClaimStrings{tokenConfig.Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}, nil
+}
+
+// signClaims signs the claims with the active signing key
+func signClaims(claims *Claims) (string, error) {
+	return signingKeys.Sign(claims)
+}
@@ -0,0 +1,250 @@
+package middlewares
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/okapi-example/models"
+)
+
+// Keyring holds the active key tokens are signed with and the previous keys they are still verified against.
+// A previous key is kept until the last token it signed has expired, so rotating does not log anyone out.
+type Keyring struct {
+	mu     sync.RWMutex
+	active *SigningKey
+	// retired maps the ID of previous keys to the time they stop verifying tokens
+	retired map[string]retiredKey
+	// overlap is how long a previous key is still accepted after a rotation
+	overlap time.Duration
+}
+
+type retiredKey struct {
+	key       *SigningKey
+	expiresAt time.Time
+}
+
+// NewKeyring creates a keyring signing with the given key.
+// Previous keys are accepted for overlap after a rotation, the lifetime of the tokens they signed.
+func NewKeyring(active *SigningKey, overlap time.Duration) *Keyring {
+	return &Keyring{active: active, retired: make(map[string]retiredKey), overlap: overlap}
+}
+
+// Rotate makes key the active key, the previous active key keeps verifying tokens until they expire
+func (k *Keyring) Rotate(key *SigningKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key.ID == k.active.ID {
+		return fmt.Errorf("key %q is already active", key.ID)
+	}
+	now := time.Now()
+	for id, r := range k.retired {
+		if now.After(r.expiresAt) {
+			delete(k.retired, id)
+		}
+	}
+	delete(k.retired, key.ID)
+	k.retired[k.active.ID] = retiredKey{key: k.active, expiresAt: now.Add(k.overlap)}
+	logger.Info("JWT signing key rotated", "kid", key.ID, "algorithm", key.Method.Alg(), "previous", k.active.ID)
+	k.active = key
+	return nil
+}
+
+// Active returns the key tokens are signed with
+func (k *Keyring) Active() *SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// Sign signs the claims with the active key, adding its ID to the token header
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	key := k.Active()
+	token := jwt.NewWithClaims(key.Method, claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	signed, err := token.SignedString(key.Private)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate JWT token: %w", err)
+	}
+	return signed, nil
+}
+
+// Keyfunc selects the verification key by the `kid` header of the token.
+// Tokens without `kid` are verified with the key whose ID is empty, if any.
+func (k *Keyring) Keyfunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	key := k.lookup(kid)
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	// Never verify with a key of another type, an RSA public key must not be used as an HMAC secret
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("signing method %s does not match key %q", token.Method.Alg(), kid)
+	}
+	return key.Public, nil
+}
+
+// lookup returns the active key or a previous key that has not expired
+func (k *Keyring) lookup(kid string) *SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.active.ID == kid {
+		return k.active
+	}
+	if r, ok := k.retired[kid]; ok && time.Now().Before(r.expiresAt) {
+		return r.key
+	}
+	return nil
+}
+
+// Methods returns the signing algorithms of the verification keys
+func (k *Keyring) Methods() []string {
+	var methods []string
+	for _, info := range k.Keys() {
+		methods = append(methods, info.Algorithm)
+	}
+	return methods
+}
+
+// Keys describes the active key and the previous keys that still verify tokens
+func (k *Keyring) Keys() []models.KeyInfo {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	now := time.Now()
+	keys := []models.KeyInfo{{Kid: k.active.ID, Algorithm: k.active.Method.Alg(), Active: true}}
+	for _, r := range k.retired {
+		if now.Before(r.expiresAt) {
+			expiresAt := r.expiresAt
+			keys = append(keys, models.KeyInfo{Kid: r.key.ID, Algorithm: r.key.Method.Alg(), ExpiresAt: &expiresAt})
+		}
+	}
+	return keys
+}
+
+// JWKS returns the public keys verifying tokens, HMAC keys are left out
+func (k *Keyring) JWKS() models.JWKS {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	now := time.Now()
+	jwks := models.JWKS{Keys: []models.JWK{}}
+	if !k.active.Symmetric() {
+		jwks.Keys = append(jwks.Keys, k.active.JWK())
+	}
+	for _, r := range k.retired {
+		if now.Before(r.expiresAt) && !r.key.Symmetric() {
+			jwks.Keys = append(jwks.Keys, r.key.JWK())
+		}
+	}
+	return jwks
+}
+
+// GenerateKey creates a random key of the same type as like, with a new ID
+func GenerateKey(like *SigningKey) (*SigningKey, error) {
+	var private any
+	var err error
+	switch k := like.Private.(type) {
+	case []byte:
+		secret := make([]byte, 64)
+		if _, err = rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to generate signing key: %w", err)
+		}
+		id, err := randomToken()
+		if err != nil {
+			return nil, err
+		}
+		return NewHMACKey(id[:16], secret), nil
+	case *rsa.PrivateKey:
+		private, err = rsa.GenerateKey(rand.Reader, k.N.BitLen())
+	case *ecdsa.PrivateKey:
+		private, err = ecdsa.GenerateKey(k.Curve, rand.Reader)
+	case ed25519.PrivateKey:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", like.Private)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+	key, err := newAsymmetricKey(private)
+	if err != nil {
+		return nil, err
+	}
+	if key.ID, err = thumbprint(key.JWK()); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// LoadKeyDir loads the newest PEM file of dir, keys are named <kid>.pem
+func LoadKeyDir(dir string) (*SigningKey, error) {
+	path, err := newestKeyFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	return LoadSigningKey(path, strings.TrimSuffix(filepath.Base(path), ".pem"))
+}
+
+// WatchKeyDir checks dir every interval and rotates to the newest key file when it changes.
+// Dropping a new <kid>.pem file in the directory rotates the signing key.
+func (k *Keyring) WatchKeyDir(dir string, interval time.Duration) {
+	// Compare with the last key loaded from the directory, not the active key,
+	// so that a rotation through the admin endpoint is not undone
+	loaded := k.Active().ID
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			key, err := LoadKeyDir(dir)
+			if err != nil {
+				logger.Error("Failed to load JWT signing keys", "dir", dir, "error", err)
+				continue
+			}
+			if key.ID == loaded {
+				continue
+			}
+			loaded = key.ID
+			if err = k.Rotate(key); err != nil {
+				logger.Error("Failed to rotate JWT signing key", "kid", key.ID, "error", err)
+			}
+		}
+	}()
+}
+
+func newestKeyFile(dir string) (string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return "", err
+	}
+	if len(paths) == 0 {
+		return "", fmt.Errorf("no *.pem key file in %s", dir)
+	}
+	modTimes := make(map[string]time.Time, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		modTimes[path] = info.ModTime()
+	}
+	// Newest first, ties broken by name so that the choice is stable
+	sort.Slice(paths, func(i, j int) bool {
+		ti, tj := modTimes[paths[i]], modTimes[paths[j]]
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return paths[i] > paths[j]
+	})
+	return paths[0], nil
+}
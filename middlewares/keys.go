@@ -0,0 +1,164 @@
+package middlewares
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jkaninda/okapi-example/models"
+)
+
+// SigningKey is a key tokens are signed and verified with.
+// Asymmetric keys publish their public part in the JWKS, HMAC keys are never published.
+type SigningKey struct {
+	ID     string
+	Method jwt.SigningMethod
+	// Private is the key tokens are signed with, the secret of HMAC keys
+	Private any
+	// Public is the key tokens are verified with, the secret of HMAC keys
+	Public any
+}
+
+// NewHMACKey creates an HS256 key from a shared secret
+func NewHMACKey(id string, secret []byte) *SigningKey {
+	return &SigningKey{ID: id, Method: jwt.SigningMethodHS256, Private: secret, Public: secret}
+}
+
+// LoadSigningKey reads an RSA, ECDSA or Ed25519 private key from a PEM file.
+// When id is empty, the key ID is the RFC 7638 thumbprint of the public key.
+func LoadSigningKey(path, id string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to read signing key %s: no PEM data found", path)
+	}
+	var private any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key %s: %w", path, err)
+	}
+	key, err := newAsymmetricKey(private)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing key %s: %w", path, err)
+	}
+	key.ID = id
+	if key.ID == "" {
+		if key.ID, err = thumbprint(key.JWK()); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func newAsymmetricKey(private any) (*SigningKey, error) {
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		return &SigningKey{Method: jwt.SigningMethodRS256, Private: k, Public: &k.PublicKey}, nil
+	case *ecdsa.PrivateKey:
+		var method jwt.SigningMethod
+		switch k.Curve {
+		case elliptic.P256():
+			method = jwt.SigningMethodES256
+		case elliptic.P384():
+			method = jwt.SigningMethodES384
+		case elliptic.P521():
+			method = jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+		}
+		return &SigningKey{Method: method, Private: k, Public: &k.PublicKey}, nil
+	case ed25519.PrivateKey:
+		return &SigningKey{Method: jwt.SigningMethodEdDSA, Private: k, Public: k.Public()}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", private)
+}
+
+// Symmetric reports whether the key is a shared secret
+func (k *SigningKey) Symmetric() bool {
+	_, ok := k.Public.([]byte)
+	return ok
+}
+
+// JWK returns the public key in JSON Web Key format, it is empty for HMAC keys
+func (k *SigningKey) JWK() models.JWK {
+	jwk := models.JWK{Kid: k.ID, Use: "sig", Alg: k.Method.Alg()}
+	switch pub := k.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	default:
+		return models.JWK{}
+	}
+	return jwk
+}
+
+// thumbprint computes the RFC 7638 thumbprint of a public key
+func thumbprint(jwk models.JWK) (string, error) {
+	var members any
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	default:
+		return "", fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+	data, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,209 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jkaninda/okapi"
+	"github.com/jkaninda/okapi-example/config"
+	"github.com/jkaninda/okapi-example/models"
+	"github.com/jkaninda/okapi-example/repositories"
+)
+
+// maxLoginBody is the size of the login requests read to find the username
+const maxLoginBody = 1 << 20
+
+// LoginGuard throttles failed logins per username and per client address,
+// and the one-time passwords checked after login per username.
+// Failures beyond the free attempts block the key for a delay doubled on every failure,
+// reaching the max attempts locks it out. Failures are forgotten a window after the last one.
+type LoginGuard struct {
+	config config.LoginConfig
+	proxy  config.ProxyConfig
+
+	mu       sync.Mutex
+	attempts map[string]*loginAttempts
+	prunedAt time.Time
+}
+
+type loginAttempts struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// NewLoginGuard creates a LoginGuard keeping its counters in memory
+func NewLoginGuard(cfg config.LoginConfig, proxy config.ProxyConfig) *LoginGuard {
+	return &LoginGuard{config: cfg, proxy: proxy, attempts: make(map[string]*loginAttempts)}
+}
+
+// Middleware rejects logins of blocked usernames and client addresses with 429 and a Retry-After header.
+// The responses of the login handler are left unchanged, its 401 responses are counted as failures.
+func (g *LoginGuard) Middleware(next okapi.HandleFunc) okapi.HandleFunc {
+	return func(c okapi.Context) error {
+		username := loginUsername(c)
+		ip := ClientIP(c, g.proxy)
+		userKey, ipKey := "user:"+username, "ip:"+ip
+		if wait := max(g.retryAfter(userKey), g.retryAfter(ipKey)); wait > 0 {
+			retryAfter := seconds(wait)
+			audit(c, "login.blocked", "username", username, "ip", ip, "retry_after", retryAfter)
+			c.SetHeader("Retry-After", strconv.Itoa(retryAfter))
+			return c.ErrorTooManyRequests(models.AuthResponse{
+				Success: false,
+				Message: fmt.Sprintf("Too many failed login attempts, retry in %d seconds", retryAfter),
+			})
+		}
+		err := next(c)
+		switch c.Response().StatusCode() {
+		case http.StatusOK:
+			g.reset(userKey)
+			audit(c, "login.succeeded", "username", username, "ip", ip)
+		case http.StatusUnauthorized:
+			failures, locked := g.fail(userKey, g.config.FreeAttempts, g.config.MaxAttempts)
+			ipFailures, ipLocked := g.fail(ipKey, g.config.IPFreeAttempts, g.config.IPMaxAttempts)
+			audit(c, "login.failed", "username", username, "ip", ip, "failures", failures, "ip_failures", ipFailures)
+			if locked {
+				audit(c, "login.locked", "username", username, "ip", ip, "duration", g.config.LockoutDuration)
+			}
+			if ipLocked {
+				audit(c, "login.locked", "ip", ip, "duration", g.config.LockoutDuration)
+			}
+		}
+		return err
+	}
+}
+
+// OTPBlockedError is returned by VerifyOTP while a username is blocked after too many invalid codes
+type OTPBlockedError struct {
+	// RetryAfter is the number of seconds until the username is unblocked
+	RetryAfter int
+}
+
+func (e *OTPBlockedError) Error() string {
+	return fmt.Sprintf("too many invalid one-time passwords, retry in %d seconds", e.RetryAfter)
+}
+
+// VerifyOTP checks the TOTP or recovery code of an authenticated user, see the VerifyOTP function.
+// Invalid codes are counted per username like failed logins, so that a stolen session can not guess the code
+// protecting the two-factor authentication settings. Blocked usernames get an *OTPBlockedError, their code is not checked.
+func (g *LoginGuard) VerifyOTP(c okapi.Context, users repositories.UserStore, user *models.User, code string) error {
+	key := "otp:" + user.Username
+	if wait := g.retryAfter(key); wait > 0 {
+		retryAfter := seconds(wait)
+		audit(c, "otp.blocked", "username", user.Username, "retry_after", retryAfter)
+		return &OTPBlockedError{RetryAfter: retryAfter}
+	}
+	err := VerifyOTP(Log(c), users, user, code)
+	switch {
+	case err == nil:
+		g.reset(key)
+	case errors.Is(err, ErrOTPInvalid):
+		failures, locked := g.fail(key, g.config.FreeAttempts, g.config.MaxAttempts)
+		audit(c, "otp.failed", "username", user.Username, "failures", failures)
+		if locked {
+			audit(c, "otp.locked", "username", user.Username, "duration", g.config.LockoutDuration)
+		}
+	}
+	return err
+}
+
+// retryAfter returns how long the key is blocked for, 0 when it is not
+func (g *LoginGuard) retryAfter(key string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	a, ok := g.attempts[key]
+	if !ok {
+		return 0
+	}
+	return max(time.Until(a.blockedUntil), 0)
+}
+
+// fail counts a failed login of the key and blocks it when it has used its free attempts.
+// It returns the failures within the window, and whether the key is locked out.
+func (g *LoginGuard) fail(key string, free, limit int) (int, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	g.prune(now)
+	a, ok := g.attempts[key]
+	if !ok || now.Sub(a.lastFailure) > g.config.Window {
+		a = &loginAttempts{}
+		g.attempts[key] = a
+	}
+	a.failures++
+	a.lastFailure = now
+	switch {
+	case a.failures >= limit:
+		a.blockedUntil = now.Add(g.config.LockoutDuration)
+		return a.failures, true
+	case a.failures > free:
+		a.blockedUntil = now.Add(g.backoff(a.failures - free))
+	}
+	return a.failures, false
+}
+
+// backoff returns the delay after the nth failure beyond the free attempts, at most the lockout duration
+func (g *LoginGuard) backoff(n int) time.Duration {
+	delay := g.config.BackoffBase
+	for i := 1; i < n && delay < g.config.LockoutDuration; i++ {
+		delay *= 2
+	}
+	return min(delay, g.config.LockoutDuration)
+}
+
+// reset forgets the failures of the key, after a successful login
+func (g *LoginGuard) reset(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.attempts, key)
+}
+
+// prune drops the keys whose failures are forgotten, at most once a minute
+func (g *LoginGuard) prune(now time.Time) {
+	if now.Sub(g.prunedAt) < time.Minute {
+		return
+	}
+	g.prunedAt = now
+	for key, a := range g.attempts {
+		if now.Sub(a.lastFailure) > g.config.Window && now.After(a.blockedUntil) {
+			delete(g.attempts, key)
+		}
+	}
+}
+
+// loginUsername reads the username of a JSON or form login request, leaving the body for the handler
+func loginUsername(c okapi.Context) string {
+	req := c.Request()
+	if req.Body == nil {
+		return ""
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxLoginBody))
+	if err != nil {
+		return ""
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	var login struct {
+		Username string `json:"username"`
+	}
+	if json.Unmarshal(body, &login) == nil {
+		return login.Username
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return ""
+	}
+	return form.Get("username")
+}
+
+// audit logs a security event, the entries share their message so that they can be filtered
+func audit(c okapi.Context, event string, args ...any) {
+	Log(c).Info("Audit", append([]any{"event", event}, args...)...)
+}
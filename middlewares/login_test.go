@@ -0,0 +1,125 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jkaninda/okapi"
+	"github.com/jkaninda/okapi-example/config"
+)
+
+var testLoginConfig = config.LoginConfig{
+	FreeAttempts:    2,
+	MaxAttempts:     5,
+	IPFreeAttempts:  3,
+	IPMaxAttempts:   4,
+	BackoffBase:     time.Second,
+	LockoutDuration: 10 * time.Second,
+	Window:          time.Minute,
+}
+
+func TestLoginGuardThresholds(t *testing.T) {
+	g := NewLoginGuard(testLoginConfig, config.ProxyConfig{})
+	for _, tc := range []struct {
+		failures int
+		blocked  time.Duration
+		locked   bool
+	}{
+		{failures: 1},
+		{failures: 2},
+		// Beyond the free attempts, the delay doubles on every failure
+		{failures: 3, blocked: time.Second},
+		{failures: 4, blocked: 2 * time.Second},
+		// The max attempts lock the key out
+		{failures: 5, blocked: 10 * time.Second, locked: true},
+		{failures: 6, blocked: 10 * time.Second, locked: true},
+	} {
+		failures, locked := g.fail("user:alice", testLoginConfig.FreeAttempts, testLoginConfig.MaxAttempts)
+		if failures != tc.failures || locked != tc.locked {
+			t.Errorf("failure %d: fail() = %d, %t, want %d, %t", tc.failures, failures, locked, tc.failures, tc.locked)
+		}
+		// Rounded up to whole seconds, like the Retry-After header
+		if blocked := time.Duration(seconds(g.retryAfter("user:alice"))) * time.Second; blocked != tc.blocked {
+			t.Errorf("failure %d: blocked for %s, want %s", tc.failures, blocked, tc.blocked)
+		}
+	}
+
+	// The delay never exceeds the lockout duration
+	for n, want := range map[int]time.Duration{1: time.Second, 3: 4 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 50: 10 * time.Second} {
+		if got := g.backoff(n); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", n, got, want)
+		}
+	}
+
+	// Failures are forgotten a window after the last one
+	g.attempts["user:alice"].lastFailure = time.Now().Add(-testLoginConfig.Window - time.Second)
+	if failures, _ := g.fail("user:alice", testLoginConfig.FreeAttempts, testLoginConfig.MaxAttempts); failures != 1 {
+		t.Errorf("failures after the window = %d, want 1", failures)
+	}
+	g.reset("user:alice")
+	if wait := g.retryAfter("user:alice"); wait != 0 {
+		t.Errorf("retryAfter() after reset = %s, want 0", wait)
+	}
+}
+
+func TestLoginGuardMiddleware(t *testing.T) {
+	g := NewLoginGuard(testLoginConfig, config.ProxyConfig{})
+	app := okapi.New()
+	app.Post("/login", g.Middleware(func(c okapi.Context) error {
+		if strings.Contains(loginUsername(c), "valid") && c.Query("password") == "right" {
+			return c.OK("logged in")
+		}
+		return c.ErrorUnauthorized("invalid username or password")
+	}))
+	login := func(username, password, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/login?password="+password, strings.NewReader(`{"username":"`+username+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 1; i <= testLoginConfig.FreeAttempts; i++ {
+		if rec := login("valid", "wrong", "192.0.2.1"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("free attempt %d status = %d, want 401", i, rec.Code)
+		}
+	}
+	// A successful login clears the failures of the username
+	if rec := login("valid", "right", "192.0.2.1"); rec.Code != http.StatusOK {
+		t.Fatalf("login status = %d, want 200", rec.Code)
+	}
+	for i := 1; i <= testLoginConfig.FreeAttempts+1; i++ {
+		if rec := login("valid", "wrong", "192.0.2.2"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d after the login status = %d, want 401", i, rec.Code)
+		}
+	}
+	// Blocked even with the right password, from any address
+	rec := login("valid", "right", "192.0.2.3")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("login during the backoff status = %d, want 429", rec.Code)
+	}
+	if retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || retryAfter != 1 {
+		t.Errorf("Retry-After = %q, want 1", rec.Header().Get("Retry-After"))
+	}
+
+	// Failures for many usernames lock the address out, other addresses are not affected
+	for i := 1; i <= testLoginConfig.IPMaxAttempts; i++ {
+		if rec = login("user"+strconv.Itoa(i), "wrong", "198.51.100.1"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d from the address status = %d, want 401", i, rec.Code)
+		}
+	}
+	if rec = login("valid-other", "right", "198.51.100.1"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("login from the locked out address status = %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != strconv.Itoa(int(testLoginConfig.LockoutDuration.Seconds())) {
+		t.Errorf("Retry-After = %q, want the lockout duration", got)
+	}
+	if rec = login("valid-other", "right", "198.51.100.2"); rec.Code != http.StatusOK {
+		t.Errorf("login from another address status = %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,58 @@
+package middlewares
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/jkaninda/okapi-example/models"
+	"github.com/jkaninda/okapi-example/repositories"
+	"github.com/jkaninda/okapi-example/utils"
+)
+
+// AMROTP is the `amr` method of logins completed with a TOTP or recovery code
+const AMROTP = "otp"
+
+var (
+	// ErrOTPRequired is returned by Login when the user has enabled two-factor authentication and no code was given
+	ErrOTPRequired = errors.New("one-time password required")
+	// ErrOTPInvalid is returned when a TOTP or recovery code is wrong or was already used
+	ErrOTPInvalid = errors.New("invalid one-time password")
+)
+
+// VerifyOTP checks a TOTP code of the user, or one of their recovery codes which is then used up.
+// The code is consumed atomically by the store, so that concurrent requests can not accept it twice.
+// The user is updated to match the store.
+func VerifyOTP(log *slog.Logger, users repositories.UserStore, user *models.User, code string) error {
+	if code == "" {
+		return ErrOTPRequired
+	}
+	if step, ok := utils.VerifyTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep); ok {
+		if err := users.ConsumeOTPStep(user.Username, step); err != nil {
+			return otpError(err)
+		}
+		user.TOTPLastStep = step
+		return nil
+	}
+	hash := utils.HashRecoveryCode(code)
+	if !slices.Contains(user.RecoveryCodes, hash) {
+		return ErrOTPInvalid
+	}
+	remaining, err := users.ConsumeRecoveryCode(user.Username, hash)
+	if err != nil {
+		return otpError(err)
+	}
+	user.RecoveryCodes = slices.DeleteFunc(user.RecoveryCodes, func(h string) bool { return h == hash })
+	log.Warn("Recovery code used", "username", user.Username, "remaining", remaining)
+	return nil
+}
+
+// otpError reports codes used by a concurrent request as invalid
+func otpError(err error) error {
+	if errors.Is(err, repositories.ErrOTPUsed) {
+		return ErrOTPInvalid
+	}
+	return fmt.Errorf("failed to save one-time password use: %w", err)
+}
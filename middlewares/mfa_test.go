@@ -0,0 +1,130 @@
+package middlewares
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jkaninda/okapi"
+	"github.com/jkaninda/okapi-example/config"
+	"github.com/jkaninda/okapi-example/models"
+	"github.com/jkaninda/okapi-example/repositories"
+	"github.com/jkaninda/okapi-example/utils"
+)
+
+// newMFAUser stores a user with two-factor authentication enabled and returns their TOTP secret and recovery code
+func newMFAUser(t *testing.T) (users *repositories.InMemoryUserStore, secret, recoveryCode string) {
+	t.Helper()
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := utils.GenerateRecoveryCodes(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users = repositories.NewInMemoryUserStore(&models.User{
+		Username:      "alice",
+		TOTPEnabled:   true,
+		TOTPSecret:    secret,
+		RecoveryCodes: []string{utils.HashRecoveryCode(codes[0]), utils.HashRecoveryCode(codes[1])},
+	})
+	return users, secret, codes[0]
+}
+
+func currentTOTP(t *testing.T, secret string) string {
+	t.Helper()
+	code, err := utils.TOTPCode(secret, utils.TOTPStep(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestVerifyOTPReplay(t *testing.T) {
+	users, secret, recoveryCode := newMFAUser(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	load := func() *models.User {
+		t.Helper()
+		user, err := users.Get("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	// stale was loaded before any code was used, like a concurrent request
+	stale := load()
+	code := currentTOTP(t, secret)
+
+	for _, tc := range []struct {
+		name string
+		user *models.User
+		code string
+		want error
+	}{
+		{"missing code", load(), "", ErrOTPRequired},
+		{"wrong code", load(), "00000x", ErrOTPInvalid},
+		{"TOTP code", load(), code, nil},
+		{"replayed TOTP code", load(), code, ErrOTPInvalid},
+		{"TOTP code replayed by a concurrent request", stale, code, ErrOTPInvalid},
+		{"recovery code", load(), strings.ToUpper(recoveryCode), nil},
+		{"used recovery code", load(), recoveryCode, ErrOTPInvalid},
+		{"recovery code used by a concurrent request", stale, recoveryCode, ErrOTPInvalid},
+	} {
+		if err := VerifyOTP(log, users, tc.user, tc.code); !errors.Is(err, tc.want) {
+			t.Errorf("%s: VerifyOTP() error = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	if user := load(); len(user.RecoveryCodes) != 1 || user.TOTPLastStep == 0 {
+		t.Errorf("stored user has %d recovery codes and last step %d, want 1 and the step of the code", len(user.RecoveryCodes), user.TOTPLastStep)
+	}
+}
+
+func TestLoginGuardVerifyOTP(t *testing.T) {
+	users, secret, _ := newMFAUser(t)
+	guard := NewLoginGuard(config.LoginConfig{
+		FreeAttempts:    1,
+		MaxAttempts:     3,
+		BackoffBase:     time.Hour,
+		LockoutDuration: 2 * time.Hour,
+		Window:          2 * time.Hour,
+	}, config.ProxyConfig{})
+	app := okapi.New()
+	app.Post("/verify", func(c okapi.Context) error {
+		user, err := users.Get("alice")
+		if err != nil {
+			return err
+		}
+		var blocked *OTPBlockedError
+		switch err = guard.VerifyOTP(c, users, user, c.Query("code")); {
+		case errors.As(err, &blocked):
+			return c.ErrorTooManyRequests(err.Error())
+		case err != nil:
+			return c.ErrorForbidden(err.Error())
+		}
+		return c.OK("verified")
+	})
+	verify := func(code string) int {
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/verify?code="+code, nil))
+		return rec.Code
+	}
+
+	for i := 1; i <= 2; i++ {
+		if status := verify("000000"); status != http.StatusForbidden {
+			t.Fatalf("wrong code %d status = %d, want 403", i, status)
+		}
+	}
+	// The free attempt is used, the backoff blocks even the right code
+	if status := verify(currentTOTP(t, secret)); status != http.StatusTooManyRequests {
+		t.Errorf("right code during the backoff status = %d, want 429", status)
+	}
+	if user, _ := users.Get("alice"); user.TOTPLastStep != 0 {
+		t.Error("a code was checked while the user was blocked")
+	}
+}
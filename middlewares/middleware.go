@@ -1,12 +1,19 @@
 package middlewares
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/jkaninda/logger"
-	"github.com/jkaninda/okapi-example/utils"
+	"github.com/jkaninda/okapi-example/config"
+	"github.com/jkaninda/okapi-example/rbac"
+	"github.com/jkaninda/okapi-example/repositories"
 	"log/slog"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -15,111 +22,338 @@ import (
 )
 
 var (
-	signingSecret = utils.GetSingingSecret()
-	JWTAuth       = &okapi.JWTAuth{
-		SigningSecret:    []byte(signingSecret),
-		Audience:         "okapi.jkaninda.dev",
-		Issuer:           "okapi.jkaninda.dev",
-		TokenLookup:      "header:Authorization",
-		ClaimsExpression: "Equals(`email_verified`, `true`) && OneOf(`user.role`, `admin`, `owner`,`user`) && Contains(`permissions`, `read`, `create`)",
+	// tokenConfig and signingKeys are set by Configure
+	tokenConfig config.JWTConfig
+	signingKeys *Keyring
+	JWTAuth     = &TokenAuth{
+		// Permissions are checked per route with RequirePermission
+		ClaimsExpression: "Equals(`email_verified`, `true`)",
 		ForwardClaims: map[string]string{
-			"email": "user.email",
-			"role":  "user.role",
-			"name":  "user.name",
+			"username": "sub",
+			"email":    "user.email",
+			"role":     "user.role",
+			"name":     "user.name",
+			"jti":      "jti",
+			"exp":      "exp",
 		},
 	}
-	AdminJWTAuth = &okapi.JWTAuth{
-		SigningSecret:    []byte(signingSecret),
-		TokenLookup:      "header:Authorization",
-		Audience:         "okapi.jkaninda.dev",
-		Issuer:           "okapi.jkaninda.dev",
-		ClaimsExpression: "Equals(`email_verified`, `true`) && Equals(`user.role`, `admin`) && Contains(`permissions`, `read`, `create`, `delete`, `update`)",
+	AdminJWTAuth = &TokenAuth{
+		ClaimsExpression: "Equals(`email_verified`, `true`)",
 		ForwardClaims: map[string]string{
-			"email": "user.email",
-			"role":  "user.role",
-			"name":  "user.name",
+			"username": "sub",
+			"email":    "user.email",
+			"role":     "user.role",
+			"name":     "user.name",
+			"jti":      "jti",
+			"exp":      "exp",
 		},
-		// CustomClaims claims validation function
-		ValidateClaims: func(context okapi.Context, claims jwt.Claims) error {
-			slog.Info("Validating JWT claims for role using custom function")
-			// Simulate a custom claims validation
-			if _, ok := claims.(jwt.Claims); ok {
+		// ValidateClaims is set by ConfigureAdmin
+	}
+	// accessPolicy is set by SetPolicy
+	accessPolicy *rbac.Policy
+)
 
-			}
-			return nil
-		},
+// Configure sets up token signing and verification, it must be called before serving requests.
+// Tokens are signed with the newest key of the keys directory, watched for new keys, when set.
+// Otherwise, they are signed with the private key file, or with the HMAC signing secret.
+func Configure(cfg config.JWTConfig) error {
+	var key *SigningKey
+	var err error
+	switch {
+	case cfg.KeysDir != "":
+		key, err = LoadKeyDir(cfg.KeysDir)
+	case cfg.PrivateKeyFile != "":
+		key, err = LoadSigningKey(cfg.PrivateKeyFile, cfg.KeyID)
+	default:
+		key = NewHMACKey("", []byte(cfg.SigningSecret))
 	}
-	jwtClaims = jwt.MapClaims{
-		"sub": "12345",
-		"iss": "okapi.jkaninda.dev",
-		"aud": "okapi.jkaninda.dev",
-		"user": map[string]string{
-			"name":  "",
-			"role":  "",
-			"email": "",
-		},
-		"email_verified": true,
-		"permissions":    []string{"read", "create"},
-		"exp":            time.Now().Add(2 * time.Hour).Unix(),
+	if err != nil {
+		return err
 	}
-	adminPermissions = []string{"read", "create", "delete", "update"}
-)
+	logger.Info("Signing JWT tokens", "algorithm", key.Method.Alg(), "kid", key.ID)
+	// Previous keys are kept as long as the tokens they signed are valid
+	keyring := NewKeyring(key, cfg.AccessTokenTTL)
+	if cfg.KeysDir != "" {
+		keyring.WatchKeyDir(cfg.KeysDir, cfg.KeysWatchInterval)
+	}
+	tokenConfig = cfg
+	signingKeys = keyring
+	for _, auth := range []*TokenAuth{JWTAuth, AdminJWTAuth} {
+		auth.Keys = keyring
+		auth.Audience = cfg.Audience
+		auth.Issuer = cfg.Issuer
+	}
+	return nil
+}
+
+// ConfigureAdmin sets up the validation of admin tokens, checking their age, authentication methods and client address.
+// The client address of API keys is checked too.
+func ConfigureAdmin(cfg config.AdminConfig, proxy config.ProxyConfig) error {
+	validator, err := NewAdminClaims(cfg, proxy)
+	if err != nil {
+		return err
+	}
+	AdminJWTAuth.ValidateClaims = validator.Validate
+	AdminAPIKeyAuth.ValidateClient = validator.ValidateClient
+	return nil
+}
 
-func Login(authRequest *models.AuthRequest) (models.AuthResponse, error) {
-	// This is where you would typically validate the user credentials against a database
+// Keys returns the keyring tokens are signed and verified with
+func Keys() *Keyring {
+	return signingKeys
+}
 
-	logger.Info("Login attempt", "username", authRequest.Username)
-	// Simulate a login function that returns a JWT token
-	if authRequest.Username != "admin" && authRequest.Password != "password" ||
-		authRequest.Username != "user" && authRequest.Password != "password" {
-		return models.AuthResponse{
-			Success: false,
-			Message: "Invalid username or password",
-		}, fmt.Errorf("username or password is wrong")
+// SetPolicy sets the role-based access control policy checked by RequirePermission
+func SetPolicy(policy *rbac.Policy) {
+	accessPolicy = policy
+}
+
+// Policy returns the role-based access control policy
+func Policy() *rbac.Policy {
+	return accessPolicy
+}
+
+// RequirePermission rejects requests whose role, forwarded from the JWT, or API key is not granted the permission.
+// Route middlewares run before group middlewares in okapi, so wrap the handler with it:
+//
+//	Handler: middlewares.RequirePermission(rbac.BooksWrite)(controller.CreateBook)
+func RequirePermission(permission string) okapi.Middleware {
+	return func(next okapi.HandleFunc) okapi.HandleFunc {
+		return func(c okapi.Context) error {
+			if !Allowed(c, permission) {
+				Log(c).Warn("Permission denied", "username", c.GetString("username"), "role", c.GetString("role"), "permission", permission)
+				return c.ErrorForbidden(models.ErrorResponse{Success: false, Status: http.StatusForbidden, Details: "missing permission " + permission, RequestID: GetRequestID(c)})
+			}
+			return next(c)
+		}
 	}
+}
 
-	if _, ok := jwtClaims["user"].(map[string]string); ok {
-		jwtClaims["user"].(map[string]string)["name"] = strings.ToUpper(authRequest.Username)
-		jwtClaims["user"].(map[string]string)["role"] = authRequest.Username
-		jwtClaims["user"].(map[string]string)["email"] = authRequest.Username + "@example.com"
-		if authRequest.Username == "admin" {
-			jwtClaims["permissions"] = adminPermissions
-		} else {
-			jwtClaims["permissions"] = []string{"read", "create"}
+// Allowed reports whether the request is granted the permission,
+// by the permissions of its API key or else by the role of its user
+func Allowed(c okapi.Context, permission string) bool {
+	if value, ok := c.Get("permissions"); ok {
+		if permissions, ok := value.([]string); ok {
+			return rbac.Grants(permissions, permission)
+		}
+	}
+	return accessPolicy.Allows(c.GetString("role"), permission)
+}
 
+// RequireBookOwner rejects changes to the book selected by the `id` path parameter when it was created by another user,
+// unless the role of the user is granted rbac.BooksAny. Books without an owner, such as the seeded ones, require rbac.BooksAny.
+// Like RequirePermission, it wraps the handler.
+func RequireBookOwner(books repositories.BookRepository) okapi.Middleware {
+	return func(next okapi.HandleFunc) okapi.HandleFunc {
+		return func(c okapi.Context) error {
+			if Allowed(c, rbac.BooksAny) {
+				return next(c)
+			}
+			id, err := strconv.Atoi(c.Param("id"))
+			if err != nil {
+				// Invalid IDs are reported by the handler
+				return next(c)
+			}
+			book, err := books.Get(id)
+			if errors.Is(err, repositories.ErrBookNotFound) {
+				return next(c)
+			}
+			if err != nil {
+				Log(c).Error("Failed to check book ownership", "id", id, "error", err)
+				return c.ErrorInternalServerError(models.ErrorResponse{Success: false, Status: http.StatusInternalServerError, Details: err.Error(), RequestID: GetRequestID(c)})
+			}
+			// Owners are identified by the subject of their token, emails can be changed by their users
+			username := c.GetString("username")
+			if username == "" || book.OwnerID != username {
+				Log(c).Warn("Book ownership denied", "username", username, "id", id, "owner", book.OwnerID)
+				return c.ErrorForbidden(models.ErrorResponse{Success: false, Status: http.StatusForbidden, Details: "book was created by another user", RequestID: GetRequestID(c)})
+			}
+			return next(c)
 		}
+	}
+}
 
+// Revocable wraps the middleware of auth so that tokens whose `jti` is in the denylist are rejected
+func Revocable(auth *TokenAuth, denylist repositories.TokenDenylist) okapi.Middleware {
+	return func(next okapi.HandleFunc) okapi.HandleFunc {
+		return auth.Middleware(func(c okapi.Context) error {
+			jti := c.GetString("jti")
+			if jti == "" {
+				return c.AbortUnauthorized("Invalid or expired token", fmt.Errorf("token has no jti claim"))
+			}
+			revoked, err := denylist.IsRevoked(jti)
+			if err != nil {
+				Log(c).Error("Failed to check token revocation", "jti", jti, "error", err)
+				return c.AbortInternalServerError("Internal Server Error", err)
+			}
+			if revoked {
+				return c.AbortUnauthorized("Token has been revoked")
+			}
+			return next(c)
+		})
 	}
-	// Set the expiration time for the JWT token
-	expireAt := 30 * time.Minute
-	jwtClaims["exp"] = time.Now().Add(expireAt).Unix()
+}
 
-	token, err := okapi.GenerateJwtToken(JWTAuth.SigningSecret, jwtClaims, expireAt)
+// TokenExpiry returns the expiration of the authenticated token, forwarded from its `exp` claim
+func TokenExpiry(c okapi.Context) time.Time {
+	exp, err := strconv.ParseInt(c.GetString("exp"), 10, 64)
 	if err != nil {
+		return time.Now().Add(tokenConfig.AccessTokenTTL)
+	}
+	return time.Unix(exp, 0)
+}
 
+func Login(log *slog.Logger, users repositories.UserStore, refreshTokens repositories.RefreshTokenStore, authRequest *models.AuthRequest) (models.AuthResponse, error) {
+	log.Info("Login attempt", "username", authRequest.Username)
+	user, err := repositories.Authenticate(users, authRequest.Username, authRequest.Password)
+	if err != nil {
 		return models.AuthResponse{
 			Success: false,
 			Message: "Invalid username or password",
-		}, fmt.Errorf("failed to generate JWT token: %w", err)
+		}, fmt.Errorf("failed to authenticate %q: %w", authRequest.Username, err)
 	}
+	amr := []string{AMRPassword}
+	if user.TOTPEnabled {
+		if err = VerifyOTP(log, users, user, authRequest.OTP); err != nil {
+			if errors.Is(err, ErrOTPRequired) {
+				return models.AuthResponse{Success: false, Message: "One-time password required", MFARequired: true}, err
+			}
+			return models.AuthResponse{Success: false, Message: "Invalid one-time password", MFARequired: true}, err
+		}
+		amr = append(amr, AMROTP, AMRMFA)
+	}
+	family, err := randomToken()
+	if err != nil {
+		return models.AuthResponse{Success: false, Message: "Invalid username or password"}, err
+	}
+	authResponse, err := issueTokens(log, refreshTokens, user, family, amr, time.Now())
+	if err != nil {
+		return models.AuthResponse{Success: false, Message: "Invalid username or password"}, err
+	}
+	authResponse.Message = "Welcome back " + user.Username
+	return authResponse, nil
+}
+
+// LoginExternal issues tokens for a user authenticated by an external identity provider,
+// amr are the authentication methods reported by the provider
+func LoginExternal(log *slog.Logger, refreshTokens repositories.RefreshTokenStore, user *models.User, amr []string) (models.AuthResponse, error) {
+	failed := models.AuthResponse{Success: false, Message: "Login failed"}
+	if user.Disabled {
+		return failed, fmt.Errorf("failed to log in %q: %w", user.Username, repositories.ErrUserDisabled)
+	}
+	family, err := randomToken()
+	if err != nil {
+		return failed, err
+	}
+	authResponse, err := issueTokens(log, refreshTokens, user, family, amr, time.Now())
+	if err != nil {
+		return failed, err
+	}
+	authResponse.Message = "Welcome back " + user.Name
+	return authResponse, nil
+}
+
+// Refresh exchanges a refresh token for a new access token and a new refresh token.
+// The presented token is consumed, presenting it again revokes every token of its family.
+func Refresh(log *slog.Logger, users repositories.UserStore, refreshTokens repositories.RefreshTokenStore, refreshRequest *models.RefreshRequest) (models.AuthResponse, error) {
+	failed := models.AuthResponse{Success: false, Message: "Invalid or expired refresh token"}
+	token, err := refreshTokens.Consume(hashToken(refreshRequest.RefreshToken))
+	if err != nil {
+		return failed, err
+	}
+	user, err := users.Get(token.Username)
+	if err != nil {
+		return failed, fmt.Errorf("failed to load %q: %w", token.Username, err)
+	}
+	if user.Disabled {
+		_ = refreshTokens.RevokeFamily(token.Family)
+		return failed, fmt.Errorf("failed to refresh %q: %w", user.Username, repositories.ErrUserDisabled)
+	}
+	authResponse, err := issueTokens(log, refreshTokens, user, token.Family, token.AMR, token.AuthTime)
+	if err != nil {
+		return failed, err
+	}
+	authResponse.Message = "Token refreshed"
+	return authResponse, nil
+}
+
+// Logout revokes the access token identified by jti and, when given, the family of the refresh token
+func Logout(refreshTokens repositories.RefreshTokenStore, denylist repositories.TokenDenylist, jti string, expiresAt time.Time, refreshToken string) error {
+	if err := denylist.Revoke(jti, expiresAt); err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	if refreshToken != "" {
+		if err := refreshTokens.Revoke(hashToken(refreshToken)); err != nil {
+			return fmt.Errorf("failed to revoke refresh token: %w", err)
+		}
+	}
+	return nil
+}
+
+// issueTokens signs an access token for the user and stores a new refresh token in the given family.
+// amr and authTime are the authentication methods and the time of the login the family was created by.
+func issueTokens(log *slog.Logger, refreshTokens repositories.RefreshTokenStore, user *models.User, family string, amr []string, authTime time.Time) (models.AuthResponse, error) {
+	claims, err := NewClaims(user, tokenConfig.AccessTokenTTL)
+	if err != nil {
+		return models.AuthResponse{}, err
+	}
+	claims.AMR = amr
+	claims.AuthTime = jwt.NewNumericDate(authTime)
+	token, err := signClaims(claims)
+	if err != nil {
+		return models.AuthResponse{}, err
+	}
+	refreshToken, err := randomToken()
+	if err != nil {
+		return models.AuthResponse{}, err
+	}
+	refreshExpiresAt := claims.IssuedAt.Add(tokenConfig.RefreshTokenTTL)
+	err = refreshTokens.Save(&models.RefreshToken{
+		Hash:      hashToken(refreshToken),
+		Family:    family,
+		Username:  user.Username,
+		ExpiresAt: refreshExpiresAt,
+		AMR:       amr,
+		AuthTime:  authTime,
+	})
+	if err != nil {
+		return models.AuthResponse{}, fmt.Errorf("failed to store refresh token: %w", err)
+	}
+	log.Info("Token issued", "username", user.Username, "jti", claims.ID)
 	return models.AuthResponse{
-		Success:   true,
-		Message:   "Welcome back " + authRequest.Username,
-		Token:     token,
-		ExpiresAt: time.Now().Add(expireAt).Unix(),
+		Success:          true,
+		Token:            token,
+		ExpiresAt:        claims.ExpiresAt.Unix(),
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpiresAt.Unix(),
 	}, nil
+}
 
+// randomToken returns 32 random bytes encoded for use in URLs and JSON
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
+
+// hashToken is the key refresh tokens are stored under, so that a leaked store can not be replayed
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func CustomMiddleware(next okapi.HandleFunc) okapi.HandleFunc {
 	return func(c okapi.Context) error {
-		slog.Info("Custom middleware executed", "path", c.Request().URL.Path, "method", c.Request().Method)
+		Log(c).Info("Custom middleware executed", "path", c.Request().URL.Path, "method", c.Request().Method)
 		// You can add any custom logic here, such as logging, authentication, etc.
 		// For example, let's log the request method and URL
-		logger.Info("Request received", "method", c.Request().Method, "url", c.Request().URL.String())
+		Log(c).Info("Request received", "method", c.Request().Method, "url", c.Request().URL.String())
 		// Call the next handler in the chain
 		if err := next(c); err != nil {
 			// If an error occurs, log it and return a generic error response
-			slog.Error("Error in custom middleware", "error", err)
+			Log(c).Error("Error in custom middleware", "error", err)
 			return c.JSON(http.StatusInternalServerError, okapi.M{"error": "Internal Server Error"})
 		}
 		return nil
@@ -0,0 +1,164 @@
+package middlewares
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jkaninda/okapi-example/config"
+	"github.com/jkaninda/okapi-example/models"
+	"github.com/jkaninda/okapi-example/repositories"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// configureTokens signs tokens with a test secret
+func configureTokens(t *testing.T) {
+	t.Helper()
+	err := Configure(config.JWTConfig{
+		SigningSecret:   "test-signing-secret-of-at-least-32-characters",
+		Issuer:          "test-issuer",
+		Audience:        "test-audience",
+		AccessTokenTTL:  time.Minute,
+		RefreshTokenTTL: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLoginConcurrentUsers checks that concurrent logins of different users never mix up their claims
+func TestLoginConcurrentUsers(t *testing.T) {
+	configureTokens(t)
+	// The lowest cost keeps the test fast, hashes of any cost are verified
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const userCount, loginsPerUser = 10, 5
+	users := repositories.NewInMemoryUserStore()
+	for i := 0; i < userCount; i++ {
+		err = users.Create(&models.User{
+			Username:      fmt.Sprintf("user%d", i),
+			Name:          fmt.Sprintf("User %d", i),
+			Email:         fmt.Sprintf("user%d@example.com", i),
+			EmailVerified: i%2 == 0,
+			PasswordHash:  string(hash),
+			Role:          fmt.Sprintf("role%d", i),
+			Permissions:   []string{fmt.Sprintf("permission%d", i)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	refreshTokens := repositories.NewInMemoryRefreshTokenStore()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	type login struct {
+		username string
+		response models.AuthResponse
+		err      error
+	}
+	logins := make(chan login, userCount*loginsPerUser)
+	var wg sync.WaitGroup
+	for i := 0; i < userCount; i++ {
+		for j := 0; j < loginsPerUser; j++ {
+			wg.Add(1)
+			go func(username string) {
+				defer wg.Done()
+				response, err := Login(log, users, refreshTokens, &models.AuthRequest{Username: username, Password: "password"})
+				logins <- login{username: username, response: response, err: err}
+			}(fmt.Sprintf("user%d", i))
+		}
+	}
+	wg.Wait()
+	close(logins)
+
+	jtis := make(map[string]string)
+	for l := range logins {
+		if l.err != nil {
+			t.Errorf("Login(%s) error = %v", l.username, l.err)
+			continue
+		}
+		claims := &Claims{}
+		if _, err = jwt.ParseWithClaims(l.response.Token, claims, signingKeys.Keyfunc); err != nil {
+			t.Errorf("token of %s: %v", l.username, err)
+			continue
+		}
+		user, err := users.Get(l.username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.Subject != user.Username {
+			t.Errorf("token of %s has sub %q", l.username, claims.Subject)
+		}
+		if claims.User != (UserClaims{Name: user.Name, Role: user.Role, Email: user.Email}) {
+			t.Errorf("token of %s has user claims %+v", l.username, claims.User)
+		}
+		if claims.EmailVerified != user.EmailVerified {
+			t.Errorf("token of %s has email_verified %t", l.username, claims.EmailVerified)
+		}
+		if !slices.Equal(claims.Permissions, user.Permissions) {
+			t.Errorf("token of %s has permissions %v", l.username, claims.Permissions)
+		}
+		if other, ok := jtis[claims.ID]; ok {
+			t.Errorf("jti %q issued to both %s and %s", claims.ID, other, l.username)
+		}
+		jtis[claims.ID] = l.username
+	}
+	if len(jtis) != userCount*loginsPerUser {
+		t.Errorf("%d distinct tokens issued, want %d", len(jtis), userCount*loginsPerUser)
+	}
+}
+
+// TestRefreshReuse presents a rotated refresh token again, which revokes every token of the login
+func TestRefreshReuse(t *testing.T) {
+	configureTokens(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := repositories.NewInMemoryUserStore(&models.User{Username: "alice", PasswordHash: string(hash), EmailVerified: true})
+	refreshTokens := repositories.NewInMemoryRefreshTokenStore()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	login := func() models.AuthResponse {
+		t.Helper()
+		response, err := Login(log, users, refreshTokens, &models.AuthRequest{Username: "alice", Password: "password"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	refresh := func(token string) (models.AuthResponse, error) {
+		return Refresh(log, users, refreshTokens, &models.RefreshRequest{RefreshToken: token})
+	}
+
+	stolen, other := login(), login()
+	rotated, err := refresh(stolen.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.RefreshToken == stolen.RefreshToken {
+		t.Fatal("the refresh token was not rotated")
+	}
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"rotated token presented again", stolen.RefreshToken, repositories.ErrRefreshTokenReused},
+		{"token issued by the rotation", rotated.RefreshToken, repositories.ErrRefreshTokenInvalid},
+		{"stolen token presented once more", stolen.RefreshToken, repositories.ErrRefreshTokenInvalid},
+		{"token of another login", other.RefreshToken, nil},
+		{"unknown token", "unknown", repositories.ErrRefreshTokenInvalid},
+	} {
+		if _, err = refresh(tc.token); !errors.Is(err, tc.want) {
+			t.Errorf("%s: Refresh() error = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package middlewares
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jkaninda/okapi"
+	"github.com/jkaninda/okapi-example/config"
+	"github.com/jkaninda/okapi-example/models"
+	"github.com/jkaninda/okapi-example/repositories"
+)
+
+// RateLimiter limits the requests of each client to a group of routes.
+// Clients are identified by their API key, the subject of their JWT, or else their address,
+// so it must run after the authentication middleware of the group.
+type RateLimiter struct {
+	// Scope separates the quotas of the groups sharing a store
+	Scope string
+	Limit config.RateLimit
+	Store repositories.RateLimitStore
+	// Proxy locates the address anonymous clients are identified by
+	Proxy config.ProxyConfig
+}
+
+// Middleware sets the RateLimit-* headers of the quota of the client, and rejects requests beyond it with 429
+func (l *RateLimiter) Middleware(next okapi.HandleFunc) okapi.HandleFunc {
+	return func(c okapi.Context) error {
+		client := l.client(c)
+		result, err := l.Store.Allow(l.Scope+":"+client, l.Limit.Requests, l.Limit.Period)
+		if err != nil {
+			// An unavailable store must not take the API down with it
+			Log(c).Error("Failed to check rate limit", "scope", l.Scope, "client", client, "error", err)
+			return next(c)
+		}
+		c.SetHeader("RateLimit-Policy", fmt.Sprintf("%d;w=%d", l.Limit.Requests, int(l.Limit.Period.Seconds())))
+		c.SetHeader("RateLimit-Limit", strconv.Itoa(l.Limit.Requests))
+		c.SetHeader("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.SetHeader("RateLimit-Reset", strconv.Itoa(seconds(result.Reset)))
+		if !result.Allowed {
+			retryAfter := seconds(result.RetryAfter)
+			Log(c).Warn("Rate limit exceeded", "scope", l.Scope, "client", client, "path", c.Request().URL.Path)
+			c.SetHeader("Retry-After", strconv.Itoa(retryAfter))
+			return c.ErrorTooManyRequests(models.ErrorResponse{
+				Success:   false,
+				Status:    http.StatusTooManyRequests,
+				Details:   fmt.Sprintf("rate limit of %d requests per %s exceeded, retry in %d seconds", l.Limit.Requests, l.Limit.Period, retryAfter),
+				RequestID: GetRequestID(c),
+			})
+		}
+		return next(c)
+	}
+}
+
+// client identifies the client of the request
+func (l *RateLimiter) client(c okapi.Context) string {
+	if id := c.GetString("api_key"); id != "" {
+		return "apikey:" + id
+	}
+	if username := c.GetString("username"); username != "" {
+		return "user:" + username
+	}
+	return "ip:" + ClientIP(c, l.Proxy)
+}
+
+// seconds rounds a duration up to whole seconds, as sent in headers
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
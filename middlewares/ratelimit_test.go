@@ -0,0 +1,77 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jkaninda/okapi"
+	"github.com/jkaninda/okapi-example/config"
+	"github.com/jkaninda/okapi-example/repositories"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := &RateLimiter{
+		Scope: "core",
+		Limit: config.RateLimit{Requests: 2, Period: time.Minute},
+		Store: repositories.NewInMemoryRateLimitStore(),
+	}
+	app := okapi.New()
+	// Stands in for the authentication middleware, which identifies the client
+	authenticate := func(next okapi.HandleFunc) okapi.HandleFunc {
+		return func(c okapi.Context) error {
+			if username := c.Query("user"); username != "" {
+				c.Set("username", username)
+			}
+			if key := c.Query("key"); key != "" {
+				c.Set("api_key", key)
+			}
+			return next(c)
+		}
+	}
+	app.Get("/", authenticate(limiter.Middleware(func(c okapi.Context) error { return c.OK("ok") })))
+	get := func(query, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i, remaining := range []string{"1", "0"} {
+		rec := get("user=alice", "192.0.2.1")
+		if rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Remaining") != remaining {
+			t.Fatalf("request %d status = %d, RateLimit-Remaining %q, want 200 and %s", i+1, rec.Code, rec.Header().Get("RateLimit-Remaining"), remaining)
+		}
+	}
+	rec := get("user=alice", "192.0.2.2")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request beyond the quota status = %d, want 429", rec.Code)
+	}
+	for header, want := range map[string]string{"Retry-After": "30", "RateLimit-Limit": "2", "RateLimit-Policy": "2;w=60", "RateLimit-Reset": "60"} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+
+	// Users, API keys and anonymous addresses have their own quotas
+	for _, tc := range []struct{ name, query, ip string }{
+		{"another user from the same address", "user=bob", "192.0.2.1"},
+		{"an API key", "key=key1", "192.0.2.1"},
+		{"an anonymous client", "", "192.0.2.1"},
+	} {
+		if rec = get(tc.query, tc.ip); rec.Code != http.StatusOK {
+			t.Errorf("%s: status = %d, want 200", tc.name, rec.Code)
+		}
+	}
+	// Anonymous clients are identified by their address, the forwarded header is not trusted
+	get("", "192.0.2.1")
+	if rec = get("", "192.0.2.1"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("third anonymous request status = %d, want 429", rec.Code)
+	}
+	if rec = get("", "192.0.2.3"); rec.Code != http.StatusOK {
+		t.Errorf("anonymous request from another address with the same forwarded header status = %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,49 @@
+package middlewares
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"regexp"
+
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/okapi"
+)
+
+// RequestIDHeader carries the ID correlating the log entries and the response of a request
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDPattern restricts the IDs accepted from clients, they end up in log entries
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestID accepts the X-Request-ID of the client, e.g. set by a proxy, or generates one.
+// The ID is stored as request_id in the context and echoed in the response, it must run before any other middleware.
+func RequestID(next okapi.HandleFunc) okapi.HandleFunc {
+	return func(c okapi.Context) error {
+		id := c.Header(RequestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		c.Set("request_id", id)
+		c.SetHeader(RequestIDHeader, id)
+		return next(c)
+	}
+}
+
+// GetRequestID returns the ID of the request, set by RequestID
+func GetRequestID(c okapi.Context) string {
+	return c.GetString("request_id")
+}
+
+// Log returns the logger of the request, adding its ID to every entry
+func Log(c okapi.Context) *slog.Logger {
+	return logger.Default().With("request_id", GetRequestID(c))
+}
+
+// newRequestID returns a random 128-bit ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	// rand.Read never fails, see its documentation
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -46,27 +46,192 @@ type Book struct {
 	Pages     int       `json:"pages" form:"pages" query:"pages" yaml:"pages" required:"false" description:"Number of pages in the book"`
 	CreatedAt time.Time `json:"createdAt" form:"createdAt" query:"createdAt" yaml:"createdAt" required:"false" description:"Book creation date"`
 	UpdatedAt time.Time `json:"updatedAt" form:"updatedAt" query:"updatedAt" yaml:"updatedAt" required:"false" description:"Book last update date"`
+	// OwnerID is the username of the user who created the book, set from the subject of their token
+	OwnerID string `json:"ownerId" form:"ownerId" query:"ownerId" yaml:"ownerId" required:"false" description:"Username of the user who created the book, read-only"`
+}
+
+// BookQuery holds the pagination, sorting and filtering parameters of a book listing
+type BookQuery struct {
+	Page     int    `query:"page" default:"1" min:"1" description:"Page number"`
+	PageSize int    `query:"pageSize" default:"20" min:"1" max:"100" description:"Number of books per page"`
+	Sort     string `query:"sort" description:"Comma-separated sort fields, prefixed with - for descending order, e.g. price,-year"`
+	Author   string `query:"author" description:"Filter by author, partial match"`
+	Country  string `query:"country" description:"Filter by country of origin"`
+	Language string `query:"language" description:"Filter by language"`
+	MinYear  int    `query:"minYear" description:"Minimum year of publication"`
+	MaxYear  int    `query:"maxYear" description:"Maximum year of publication"`
+	MinPrice int    `query:"minPrice" description:"Minimum price"`
+	MaxPrice int    `query:"maxPrice" description:"Maximum price"`
+}
+
+// BookPage is a paginated list of books
+type BookPage struct {
+	Data       []Book `json:"data"`
+	Total      int    `json:"total"`
+	Page       int    `json:"page"`
+	PageSize   int    `json:"pageSize"`
+	TotalPages int    `json:"totalPages"`
+}
+
+// SearchQuery holds the parameters of a full-text book search
+type SearchQuery struct {
+	Q     string `query:"q" required:"true" description:"Search terms, matched against title and author"`
+	Limit int    `query:"limit" default:"20" min:"1" max:"100" description:"Maximum number of results"`
+}
+
+// SearchResult is a book matching a search, with the matched terms highlighted
+type SearchResult struct {
+	Book       Book            `json:"book"`
+	Score      float64         `json:"score"`
+	Highlights SearchHighlight `json:"highlights"`
+}
+
+// SearchHighlight holds HTML escaped field values with matched terms wrapped in <mark> tags
+type SearchHighlight struct {
+	Title  string `json:"title"`
+	Author string `json:"author"`
+}
+
+// SearchResponse lists the books matching a search, best matches first
+type SearchResponse struct {
+	Query   string         `json:"query"`
+	Total   int            `json:"total"`
+	Results []SearchResult `json:"results"`
 }
 type ErrorResponse struct {
 	Success bool `json:"success"`
 	Status  int  `json:"status"`
 	Details any  `json:"details"`
+	// RequestID is the X-Request-ID of the request, to find its log entries
+	RequestID string `json:"requestId,omitempty"`
 }
 
 type AuthRequest struct {
 	Username string `json:"username" required:"true" description:"Username for authentication"`
 	Password string `json:"password" required:"true" description:"Password for authentication"`
+	OTP      string `json:"otp" required:"false" description:"TOTP code or recovery code, required when two-factor authentication is enabled"`
 }
 type AuthResponse struct {
-	Success   bool   `json:"success"`
-	Message   string `json:"message"`
-	Token     string `json:"token,omitempty"`
-	ExpiresAt int64  `json:"expires,omitempty"`
+	Success          bool   `json:"success"`
+	Message          string `json:"message"`
+	Token            string `json:"token,omitempty"`
+	ExpiresAt        int64  `json:"expires,omitempty"`
+	RefreshToken     string `json:"refreshToken,omitempty"`
+	RefreshExpiresAt int64  `json:"refreshExpires,omitempty"`
+	// MFARequired asks the client to log in again with a one-time password
+	MFARequired bool `json:"mfaRequired,omitempty"`
+}
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken" required:"true" description:"Refresh token returned by the last login or refresh"`
+}
+type LogoutRequest struct {
+	RefreshToken string `json:"refreshToken" description:"Refresh token to revoke along with the JWT token"`
+}
+type RevokeTokenRequest struct {
+	Jti string `json:"jti" required:"true" description:"ID of the JWT token to revoke"`
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// KeyInfo describes a JWT signing key, previous keys verify tokens until ExpiresAt
+type KeyInfo struct {
+	Kid       string     `json:"kid"`
+	Algorithm string     `json:"algorithm"`
+	Active    bool       `json:"active"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// RefreshToken is the server-side record of an issued refresh token.
+// Tokens rotated from the same login share a Family.
+type RefreshToken struct {
+	Hash      string
+	Family    string
+	Username  string
+	ExpiresAt time.Time
+	Used      bool
+	Revoked   bool
+	// AMR are the authentication methods of the login, carried over to refreshed tokens
+	AMR []string
+	// AuthTime is the time of the login, carried over to refreshed tokens
+	AuthTime time.Time
+}
+
+// User is an account allowed to log in
+type User struct {
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	// EmailVerified is set once the email is known to belong to the user, tokens of unverified users are rejected
+	EmailVerified bool     `json:"emailVerified"`
+	PasswordHash  string   `json:"passwordHash"`
+	Role          string   `json:"role"`
+	Permissions   []string `json:"permissions"`
+	Disabled      bool     `json:"disabled"`
+	// TOTPSecret is set on enrollment, TOTPEnabled once a code has been verified
+	TOTPSecret  string `json:"totpSecret,omitempty"`
+	TOTPEnabled bool   `json:"totpEnabled,omitempty"`
+	// TOTPLastStep is the time step of the last accepted code, a code is only accepted once
+	TOTPLastStep int64 `json:"totpLastStep,omitempty"`
+	// RecoveryCodes are the hashes of the unused recovery codes
+	RecoveryCodes []string  `json:"recoveryCodes,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
 }
 type UserInfo struct {
-	Name  string `json:"name"`
-	Email string `json:"email"`
-	Role  string `json:"role"`
+	Username      string   `json:"username,omitempty"`
+	Name          string   `json:"name"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"emailVerified"`
+	Role          string   `json:"role"`
+	Permissions   []string `json:"permissions,omitempty"`
+	Disabled      bool     `json:"disabled,omitempty"`
+	MFAEnabled    bool     `json:"mfaEnabled,omitempty"`
+}
+
+type RegisterRequest struct {
+	Username string `json:"username" required:"true" description:"Username, letters, digits, dots, dashes and underscores"`
+	Password string `json:"password" required:"true" description:"Password, at least 8 characters"`
+	Name     string `json:"name" description:"Display name"`
+	Email    string `json:"email" required:"true" description:"Email address"`
+}
+type UpdateProfileRequest struct {
+	Name  string `json:"name" required:"true" description:"Display name"`
+	Email string `json:"email" required:"true" description:"Email address"`
+}
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword" required:"true" description:"Current password"`
+	NewPassword     string `json:"newPassword" required:"true" description:"New password, at least 8 characters"`
+}
+type ChangeRoleRequest struct {
+	Role string `json:"role" required:"true" description:"New role, grants the permissions of that role"`
+}
+
+// TOTPEnrollment holds the secret to enroll an authenticator app with
+type TOTPEnrollment struct {
+	Secret string `json:"secret" description:"Base32 secret, to type in manually"`
+	URI    string `json:"uri" description:"otpauth:// provisioning URI, to show as a QR code"`
+}
+type TOTPCodeRequest struct {
+	Code string `json:"code" required:"true" description:"Current code of the authenticator app, or a recovery code when disabling"`
+}
+
+// RecoveryCodes are shown once, each can replace a TOTP code for a single login
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
 }
 
 type WhoAmIResponse struct {
@@ -74,3 +239,42 @@ type WhoAmIResponse struct {
 	RealIp      string   `json:"realIp"`
 	CurrentUser UserInfo `json:"currentUser"`
 }
+
+// APIKey is a key services authenticate with in the X-API-Key header, only the hash of the key is stored
+type APIKey struct {
+	// ID is the public part of the key, keys are formatted as okapi_<id>_<secret>
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Hash        string    `json:"hash"`
+	Permissions []string  `json:"permissions"`
+	CreatedBy   string    `json:"createdBy"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// ExpiresAt is zero for keys that never expire
+	ExpiresAt  time.Time `json:"expiresAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	Revoked    bool      `json:"revoked"`
+}
+
+// APIKeyInfo describes an API key without its secret
+type APIKeyInfo struct {
+	ID          string     `json:"id"`
+	Prefix      string     `json:"prefix" description:"Start of the key, to recognize it"`
+	Name        string     `json:"name"`
+	Permissions []string   `json:"permissions"`
+	CreatedBy   string     `json:"createdBy"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt  *time.Time `json:"lastUsedAt,omitempty"`
+	Revoked     bool       `json:"revoked,omitempty"`
+}
+type CreateAPIKeyRequest struct {
+	Name        string   `json:"name" required:"true" description:"What the key is used for"`
+	Permissions []string `json:"permissions" required:"true" description:"Permissions granted to the key, among those of the current user"`
+	ExpiresIn   string   `json:"expiresIn" description:"Lifetime of the key, e.g. 720h, it never expires when empty"`
+}
+
+// CreatedAPIKey holds a new API key, it is shown once
+type CreatedAPIKey struct {
+	Key string `json:"key" description:"The API key, send it in the X-API-Key header"`
+	APIKeyInfo
+}
@@ -0,0 +1,260 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jkaninda/okapi-example/models"
+)
+
+// keysRefreshInterval limits how often the JWKS is fetched again for an unknown key ID
+const keysRefreshInterval = time.Minute
+
+// ErrEmailNotVerified is returned for users whose email the provider has not verified
+var ErrEmailNotVerified = errors.New("email address is not verified by the identity provider")
+
+// Identity is the user authenticated by the provider, with their claims mapped to the local ones
+type Identity struct {
+	Issuer string
+	// Subject identifies the user at the provider
+	Subject string
+	Email   string
+	Name    string
+	// Role is the local role mapped from the role claim
+	Role string
+	// AMR are the authentication methods reported by the provider
+	AMR []string
+}
+
+// verify checks the signature, issuer, audience, expiration and nonce of an ID token and maps its claims
+func (p *Provider) verify(ctx context.Context, rawIDToken, nonce string) (*Identity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, claims,
+		func(token *jwt.Token) (any, error) {
+			kid, _ := token.Header["kid"].(string)
+			return p.keys.key(ctx, kid)
+		},
+		jwt.WithValidMethods(p.signingMethods()),
+		jwt.WithIssuer(p.config.Issuer),
+		jwt.WithAudience(p.config.ClientID),
+		jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("invalid ID token: nonce does not match")
+	}
+	identity := &Identity{Issuer: p.config.Issuer, AMR: stringValues(claims["amr"])}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	if identity.Subject == "" || identity.Email == "" {
+		return nil, errors.New("ID token lacks the sub or email claim, request the email scope")
+	}
+	// Local tokens claim a verified email, which JWTAuth requires
+	if verified, _ := claims["email_verified"].(bool); !verified {
+		return nil, ErrEmailNotVerified
+	}
+	if identity.Name, _ = claims["name"].(string); identity.Name == "" {
+		identity.Name, _ = claims["preferred_username"].(string)
+	}
+	identity.Role = p.mapRole(stringValues(claims[p.config.RoleClaim]))
+	return identity, nil
+}
+
+// mapRole returns the role of the first mapping matching one of the values, or the default role
+func (p *Provider) mapRole(values []string) string {
+	for _, m := range p.mappings {
+		if slices.Contains(values, m.Value) {
+			return m.Role
+		}
+	}
+	return p.config.DefaultRole
+}
+
+// Username is the local username of the identity, derived from the issuer and subject.
+// Subjects are only unique per issuer and may contain characters not allowed in usernames.
+func (id *Identity) Username() string {
+	sum := sha256.Sum256([]byte(id.Issuer + "|" + id.Subject))
+	return "oidc-" + hex.EncodeToString(sum[:])[:20]
+}
+
+// signingMethods are the algorithms ID tokens may be signed with, never HMAC nor none
+func (p *Provider) signingMethods() []string {
+	supported := []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+	if len(p.metadata.SigningAlgorithms) == 0 {
+		// RS256 is the default of OpenID Connect
+		return []string{"RS256"}
+	}
+	var methods []string
+	for _, alg := range p.metadata.SigningAlgorithms {
+		if slices.Contains(supported, alg) {
+			methods = append(methods, alg)
+		}
+	}
+	return methods
+}
+
+// stringValues returns a claim holding a string or a list of strings as a list
+func stringValues(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// keySet caches the public keys of the provider, fetched from its JWKS endpoint
+type keySet struct {
+	url   string
+	fetch func(ctx context.Context, url string, v any) error
+
+	mu        sync.Mutex
+	keys      map[string]any
+	fetchedAt time.Time
+}
+
+// key returns the key with the given ID, fetching the JWKS again when it is unknown, e.g. after a key rotation
+func (s *keySet) key(ctx context.Context, kid string) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.lookup(kid); ok {
+		return key, nil
+	}
+	if time.Since(s.fetchedAt) < keysRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	var jwks models.JWKS
+	if err := s.fetch(ctx, s.url, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	s.fetchedAt = time.Now()
+	s.keys = make(map[string]any, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := publicKey(jwk)
+		if err != nil {
+			// Skip keys of unsupported types, the provider may publish keys for other uses
+			continue
+		}
+		s.keys[jwk.Kid] = key
+	}
+	if key, ok := s.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookup returns the key with the given ID, tokens without ID match the only key of the set
+func (s *keySet) lookup(kid string) (any, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// publicKey decodes an RSA, ECDSA or Ed25519 public key in JSON Web Key format
+func publicKey(jwk models.JWK) (any, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
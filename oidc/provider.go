@@ -0,0 +1,242 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+// Package oidc delegates logins to an OpenID Connect provider
+// with the authorization code flow and PKCE (RFC 7636)
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jkaninda/okapi-example/config"
+)
+
+// LoginTimeout is how long a user has to complete the login at the provider
+const LoginTimeout = 10 * time.Minute
+
+// maxPendingLogins bounds the logins started and not completed yet, each holds memory until it expires
+const maxPendingLogins = 10000
+
+var (
+	// ErrInvalidState is returned for callbacks of unknown, used or expired logins
+	ErrInvalidState = errors.New("invalid or expired login state")
+	// ErrTooManyLogins is returned by AuthCodeURL when too many logins are pending
+	ErrTooManyLogins = errors.New("too many pending logins, retry later")
+)
+
+// Provider is an OpenID Connect provider, configured from its discovery document
+type Provider struct {
+	config   config.OIDCConfig
+	mappings []config.RoleMapping
+	client   *http.Client
+	metadata metadata
+	keys     *keySet
+
+	mu sync.Mutex
+	// pending maps the state of logins started by AuthCodeURL to their PKCE verifier and nonce
+	pending map[string]pendingLogin
+}
+
+// metadata holds the fields of the discovery document used by the flow, see OpenID Connect Discovery 1.0
+type metadata struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	SigningAlgorithms     []string `json:"id_token_signing_alg_values_supported"`
+}
+
+type pendingLogin struct {
+	verifier  string
+	nonce     string
+	expiresAt time.Time
+}
+
+// Discover fetches the discovery document of the issuer and creates the provider
+func Discover(ctx context.Context, cfg config.OIDCConfig) (*Provider, error) {
+	mappings, err := cfg.Mappings()
+	if err != nil {
+		return nil, err
+	}
+	p := &Provider{
+		config:   cfg,
+		mappings: mappings,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		pending:  make(map[string]pendingLogin),
+	}
+	discoveryURL := strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err = p.getJSON(ctx, discoveryURL, &p.metadata); err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC provider: %w", err)
+	}
+	// The issuer of the document must be the configured one, ID tokens are checked against it
+	if p.metadata.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("OIDC discovery document issuer %q does not match %q", p.metadata.Issuer, cfg.Issuer)
+	}
+	if p.metadata.AuthorizationEndpoint == "" || p.metadata.TokenEndpoint == "" || p.metadata.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery document lacks the authorization, token or JWKS endpoint")
+	}
+	p.keys = &keySet{url: p.metadata.JWKSURI, fetch: p.getJSON}
+	return p, nil
+}
+
+// Roles returns the local roles the provider maps users to, so that they can be checked against the RBAC policy
+func (p *Provider) Roles() []string {
+	roles := []string{p.config.DefaultRole}
+	for _, m := range p.mappings {
+		roles = append(roles, m.Role)
+	}
+	return roles
+}
+
+// AuthCodeURL starts a login and returns the authorization URL of the provider to redirect the user to,
+// and the state of the login, which the caller binds to the browser of the user
+func (p *Provider) AuthCodeURL() (authURL, state string, err error) {
+	state, err = randomString()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	p.mu.Lock()
+	now := time.Now()
+	for s, login := range p.pending {
+		if now.After(login.expiresAt) {
+			delete(p.pending, s)
+		}
+	}
+	if len(p.pending) >= maxPendingLogins {
+		p.mu.Unlock()
+		return "", "", ErrTooManyLogins
+	}
+	p.pending[state] = pendingLogin{verifier: verifier, nonce: nonce, expiresAt: now.Add(LoginTimeout)}
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.config.ClientID)
+	query.Set("redirect_uri", p.config.RedirectURL)
+	query.Set("scope", strings.Join(p.config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	separator := "?"
+	if strings.Contains(p.metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.metadata.AuthorizationEndpoint + separator + query.Encode(), state, nil
+}
+
+// Exchange completes the login identified by state, exchanging the authorization code for an ID token.
+// It returns the identity of the user, read from the verified ID token.
+func (p *Provider) Exchange(ctx context.Context, state, code string) (*Identity, error) {
+	p.mu.Lock()
+	login, ok := p.pending[state]
+	// A state is only accepted once
+	delete(p.pending, state)
+	p.mu.Unlock()
+	if !ok || time.Now().After(login.expiresAt) {
+		return nil, ErrInvalidState
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", login.verifier)
+	form.Set("client_id", p.config.ClientID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange authorization code: %w", err)
+	}
+	defer res.Body.Close()
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&token); err != nil {
+		return nil, fmt.Errorf("failed to read token response: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to exchange authorization code: %s %s", token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+	return p.verify(ctx, token.IDToken, login.nonce)
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %s", url, res.Status)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+// randomString returns 32 random bytes encoded for use in URLs, as required for PKCE verifiers
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random value: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
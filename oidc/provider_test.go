@@ -0,0 +1,521 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jkaninda/okapi-example/config"
+	"github.com/jkaninda/okapi-example/models"
+)
+
+const (
+	testClientID    = "okapi"
+	testRedirectURL = "http://localhost:8080/auth/oidc/callback"
+)
+
+// fakeProvider is an OpenID Connect provider serving discovery, JWKS and a token endpoint.
+// Authorization is done by the test with authorize, which issues a code for an authorization URL.
+type fakeProvider struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu sync.Mutex
+	// keys are the published keys, signing is the ID of the one signing ID tokens
+	keys    map[string]*rsa.PrivateKey
+	signing string
+	codes   map[string]grant
+	// claims modifies the claims of the next ID tokens
+	claims func(claims jwt.MapClaims)
+	// sign replaces the signature of the next ID tokens
+	sign       func(claims jwt.MapClaims) string
+	jwksHits   int
+	tokenCalls int
+}
+
+// grant is an issued authorization code
+type grant struct {
+	challenge string
+	nonce     string
+	subject   string
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	t.Helper()
+	f := &fakeProvider{t: t, keys: make(map[string]*rsa.PrivateKey), codes: make(map[string]grant)}
+	f.rotate("key-1")
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"issuer":                                f.issuer(),
+			"authorization_endpoint":                f.issuer() + "/authorize",
+			"token_endpoint":                        f.issuer() + "/token",
+			"jwks_uri":                              f.issuer() + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256", "HS256", "none"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.jwksHits++
+		jwks := models.JWKS{}
+		for kid, key := range f.keys {
+			jwks.Keys = append(jwks.Keys, models.JWK{
+				Kty: "RSA", Kid: kid, Use: "sig", Alg: "RS256",
+				N: base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		writeJSON(w, http.StatusOK, jwks)
+	})
+	mux.HandleFunc("POST /token", f.token)
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeProvider) issuer() string {
+	return f.server.URL
+}
+
+// rotate publishes a new key and signs the next ID tokens with it
+func (f *fakeProvider) rotate(kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keys[kid] = key
+	f.signing = kid
+}
+
+// retire stops publishing a key
+func (f *fakeProvider) retire(kid string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.keys, kid)
+}
+
+// authorize plays the user logging in at the provider, it returns the state and the code of the callback
+func (f *fakeProvider) authorize(authURL, subject string) (state, code string) {
+	f.t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	query := u.Query()
+	if got := query.Get("code_challenge_method"); got != "S256" {
+		f.t.Fatalf("code_challenge_method = %q, want S256", got)
+	}
+	if query.Get("client_id") != testClientID || query.Get("redirect_uri") != testRedirectURL {
+		f.t.Fatalf("unexpected client_id or redirect_uri in %s", authURL)
+	}
+	code = fmt.Sprintf("code-%d", time.Now().UnixNano())
+	f.mu.Lock()
+	f.codes[code] = grant{challenge: query.Get("code_challenge"), nonce: query.Get("nonce"), subject: subject}
+	f.mu.Unlock()
+	return query.Get("state"), code
+}
+
+// token exchanges an authorization code for an ID token, checking the PKCE verifier
+func (f *fakeProvider) token(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tokenCalls++
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	g, ok := f.codes[r.PostForm.Get("code")]
+	delete(f.codes, r.PostForm.Get("code"))
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("redirect_uri") != testRedirectURL {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            f.issuer(),
+		"aud":            testClientID,
+		"sub":            g.subject,
+		"email":          g.subject + "@example.com",
+		"email_verified": true,
+		"name":           "User " + g.subject,
+		"groups":         []string{"staff"},
+		"amr":            []string{"pwd", "mfa"},
+		"nonce":          g.nonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Minute).Unix(),
+	}
+	if f.claims != nil {
+		f.claims(claims)
+	}
+	var idToken string
+	if f.sign != nil {
+		idToken = f.sign(claims)
+	} else {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = f.signing
+		var err error
+		if idToken, err = token.SignedString(f.keys[f.signing]); err != nil {
+			f.t.Error(err)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"access_token": "access", "token_type": "Bearer", "id_token": idToken})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// discover creates a Provider for the fake provider
+func (f *fakeProvider) discover(mappings ...string) *Provider {
+	f.t.Helper()
+	p, err := Discover(context.Background(), config.OIDCConfig{
+		Issuer:       f.issuer(),
+		ClientID:     testClientID,
+		RedirectURL:  testRedirectURL,
+		Scopes:       []string{"openid", "profile", "email"},
+		RoleClaim:    "groups",
+		RoleMappings: mappings,
+		DefaultRole:  "user",
+	})
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return p
+}
+
+// login runs a complete login of the subject
+func (f *fakeProvider) login(p *Provider, subject string) (*Identity, error) {
+	f.t.Helper()
+	authURL, state, err := p.AuthCodeURL()
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	callbackState, code := f.authorize(authURL, subject)
+	if callbackState != state {
+		f.t.Fatalf("authorization URL state = %q, AuthCodeURL returned %q", callbackState, state)
+	}
+	return p.Exchange(context.Background(), state, code)
+}
+
+func TestLogin(t *testing.T) {
+	f := newFakeProvider(t)
+	p := f.discover("okapi-admins=admin", "staff=editor")
+
+	identity, err := f.login(p, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Identity{Issuer: f.issuer(), Subject: "alice", Email: "alice@example.com", Name: "User alice", Role: "editor"}
+	if identity.Issuer != want.Issuer || identity.Subject != want.Subject || identity.Email != want.Email ||
+		identity.Name != want.Name || identity.Role != want.Role {
+		t.Errorf("identity = %+v, want %+v", identity, want)
+	}
+	if strings.Join(identity.AMR, ",") != "pwd,mfa" {
+		t.Errorf("AMR = %v, want [pwd mfa]", identity.AMR)
+	}
+	if !strings.HasPrefix(identity.Username(), "oidc-") || identity.Username() != (&Identity{Issuer: f.issuer(), Subject: "alice"}).Username() {
+		t.Errorf("Username() = %q is not derived from the issuer and subject", identity.Username())
+	}
+}
+
+func TestRoleMapping(t *testing.T) {
+	f := newFakeProvider(t)
+	p := f.discover("okapi-admins=admin", "staff=editor")
+	for _, tc := range []struct {
+		name   string
+		groups any
+		role   string
+	}{
+		{"first matching rule wins", []string{"staff", "okapi-admins"}, "admin"},
+		{"single string claim", "staff", "editor"},
+		{"no match", []string{"others"}, "user"},
+		{"missing claim", nil, "user"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f.claims = func(claims jwt.MapClaims) {
+				claims["groups"] = tc.groups
+				if tc.groups == nil {
+					delete(claims, "groups")
+				}
+			}
+			identity, err := f.login(p, "bob")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity.Role != tc.role {
+				t.Errorf("role = %q, want %q", identity.Role, tc.role)
+			}
+		})
+	}
+	if roles := strings.Join(p.Roles(), ","); roles != "user,admin,editor" {
+		t.Errorf("Roles() = %s, want user,admin,editor", roles)
+	}
+}
+
+func TestPKCEVerifier(t *testing.T) {
+	f := newFakeProvider(t)
+	p := f.discover()
+	authURL, state, err := p.AuthCodeURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, code := f.authorize(authURL, "alice")
+	// The code is bound to another challenge, e.g. it was intercepted and replayed with the attacker's verifier
+	f.mu.Lock()
+	g := f.codes[code]
+	sum := sha256.Sum256([]byte("attacker verifier"))
+	g.challenge = base64.RawURLEncoding.EncodeToString(sum[:])
+	f.codes[code] = g
+	f.mu.Unlock()
+	if _, err = p.Exchange(context.Background(), state, code); err == nil || !strings.Contains(err.Error(), "PKCE") {
+		t.Errorf("Exchange() with a mismatched verifier error = %v, want a PKCE failure", err)
+	}
+
+	// Every login has its own verifier
+	first, _, err := p.AuthCodeURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := p.AuthCodeURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := func(authURL string) string {
+		u, _ := url.Parse(authURL)
+		return u.Query().Get("code_challenge")
+	}
+	if challenge(first) == "" || challenge(first) == challenge(second) {
+		t.Errorf("code challenges %q and %q are empty or reused", challenge(first), challenge(second))
+	}
+}
+
+func TestState(t *testing.T) {
+	f := newFakeProvider(t)
+	p := f.discover()
+
+	authURL, state, err := p.AuthCodeURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, code := f.authorize(authURL, "alice")
+	if _, err = p.Exchange(context.Background(), state, code); err != nil {
+		t.Fatal(err)
+	}
+	calls := f.tokenCalls
+	// A state is only accepted once, the code is not sent to the provider again
+	_, code = f.authorize(authURL, "alice")
+	if _, err = p.Exchange(context.Background(), state, code); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Exchange() with a used state error = %v, want ErrInvalidState", err)
+	}
+	if _, err = p.Exchange(context.Background(), "unknown", code); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Exchange() with an unknown state error = %v, want ErrInvalidState", err)
+	}
+	if f.tokenCalls != calls {
+		t.Errorf("token endpoint called %d times for invalid states", f.tokenCalls-calls)
+	}
+
+	authURL, state, err = p.AuthCodeURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, code = f.authorize(authURL, "alice")
+	p.mu.Lock()
+	login := p.pending[state]
+	login.expiresAt = time.Now().Add(-time.Second)
+	p.pending[state] = login
+	p.mu.Unlock()
+	if _, err = p.Exchange(context.Background(), state, code); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Exchange() with an expired state error = %v, want ErrInvalidState", err)
+	}
+}
+
+func TestPendingLoginsLimit(t *testing.T) {
+	f := newFakeProvider(t)
+	p := f.discover()
+	p.mu.Lock()
+	for i := 0; i < maxPendingLogins; i++ {
+		p.pending[fmt.Sprint(i)] = pendingLogin{expiresAt: time.Now().Add(LoginTimeout)}
+	}
+	p.mu.Unlock()
+	if _, _, err := p.AuthCodeURL(); !errors.Is(err, ErrTooManyLogins) {
+		t.Fatalf("AuthCodeURL() with %d pending logins error = %v, want ErrTooManyLogins", maxPendingLogins, err)
+	}
+	// Expired logins are dropped and make room for new ones
+	p.mu.Lock()
+	p.pending["0"] = pendingLogin{expiresAt: time.Now().Add(-time.Second)}
+	p.mu.Unlock()
+	if _, _, err := p.AuthCodeURL(); err != nil {
+		t.Errorf("AuthCodeURL() after a login expired error = %v", err)
+	}
+}
+
+func TestIDTokenValidation(t *testing.T) {
+	f := newFakeProvider(t)
+	p := f.discover()
+	hmacKey, err := x509.MarshalPKIXPublicKey(&f.keys["key-1"].PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		claims func(claims jwt.MapClaims)
+		sign   func(claims jwt.MapClaims) string
+		want   error
+	}{
+		{name: "nonce mismatch", claims: func(c jwt.MapClaims) { c["nonce"] = "other" }},
+		{name: "missing nonce", claims: func(c jwt.MapClaims) { delete(c, "nonce") }},
+		{name: "wrong issuer", claims: func(c jwt.MapClaims) { c["iss"] = "https://attacker.example.com" }},
+		{name: "wrong audience", claims: func(c jwt.MapClaims) { c["aud"] = "another-client" }},
+		{name: "expired", claims: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }},
+		{name: "missing expiration", claims: func(c jwt.MapClaims) { delete(c, "exp") }},
+		{name: "missing email", claims: func(c jwt.MapClaims) { delete(c, "email") }},
+		{name: "unverified email", claims: func(c jwt.MapClaims) { c["email_verified"] = false }, want: ErrEmailNotVerified},
+		{
+			// The provider advertises HS256, the public key must not be usable as an HMAC secret
+			name: "HMAC signed with the public key",
+			sign: func(c jwt.MapClaims) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodHS256, c)
+				token.Header["kid"] = "key-1"
+				s, _ := token.SignedString(hmacKey)
+				return s
+			},
+		},
+		{
+			name: "unsigned",
+			sign: func(c jwt.MapClaims) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodNone, c)
+				token.Header["kid"] = "key-1"
+				s, _ := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+				return s
+			},
+		},
+		{
+			name: "signed with an unpublished key",
+			sign: func(c jwt.MapClaims) string {
+				key, _ := rsa.GenerateKey(rand.Reader, 2048)
+				token := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+				token.Header["kid"] = "key-1"
+				s, _ := token.SignedString(key)
+				return s
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f.claims, f.sign = tc.claims, tc.sign
+			identity, err := f.login(p, "alice")
+			if err == nil {
+				t.Fatalf("login succeeded with identity %+v", identity)
+			}
+			if tc.want != nil && !errors.Is(err, tc.want) {
+				t.Errorf("error = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	f := newFakeProvider(t)
+	p := f.discover()
+	if _, err := f.login(p, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if f.jwksHits != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", f.jwksHits)
+	}
+
+	f.rotate("key-2")
+	// Unknown keys are not fetched again right away, so that tokens with random key IDs can not flood the provider
+	if _, err := f.login(p, "alice"); err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+		t.Errorf("login right after the rotation error = %v, want an unknown signing key", err)
+	}
+	if f.jwksHits != 1 {
+		t.Errorf("JWKS fetched %d times within the refresh interval, want 1", f.jwksHits)
+	}
+
+	// Once the refresh interval has passed, the new key is fetched
+	p.keys.mu.Lock()
+	p.keys.fetchedAt = time.Now().Add(-keysRefreshInterval)
+	p.keys.mu.Unlock()
+	if _, err := f.login(p, "alice"); err != nil {
+		t.Fatalf("login with the rotated key error = %v", err)
+	}
+	if f.jwksHits != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", f.jwksHits)
+	}
+
+	// Retired keys stop verifying tokens once the JWKS is fetched again
+	f.retire("key-1")
+	p.keys.mu.Lock()
+	p.keys.fetchedAt = time.Now().Add(-keysRefreshInterval)
+	p.keys.mu.Unlock()
+	f.rotate("key-3")
+	if _, err := f.login(p, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.keys.lookup("key-1"); ok {
+		t.Error("retired key-1 is still trusted")
+	}
+}
+
+func TestDiscoverIssuerMismatch(t *testing.T) {
+	f := newFakeProvider(t)
+	_, err := Discover(context.Background(), config.OIDCConfig{
+		// Same provider, but not the configured issuer URL
+		Issuer:      f.issuer() + "/",
+		ClientID:    testClientID,
+		RedirectURL: testRedirectURL,
+		DefaultRole: "user",
+	})
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("Discover() error = %v, want an issuer mismatch", err)
+	}
+}
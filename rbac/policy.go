@@ -0,0 +1,159 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+// Package rbac grants permissions to roles, as declared in a policy file
+package rbac
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Permissions checked by the routes
+const (
+	BooksRead   = "books:read"
+	BooksWrite  = "books:write"
+	BooksDelete = "books:delete"
+	// BooksAny allows changing books created by other users, see middlewares.RequireBookOwner
+	BooksAny   = "books:any"
+	UsersAdmin = "users:admin"
+	KeysAdmin  = "keys:admin"
+	// APIKeysAdmin allows managing the API keys of services
+	APIKeysAdmin = "apikeys:admin"
+)
+
+// Policy maps roles to the permissions they are granted.
+// A permission ending with `*` grants every permission with that prefix, e.g. `books:*`.
+type Policy struct {
+	roles map[string][]string
+}
+
+// policyFile is the format of the policy file, roles inherit the permissions of other roles
+type policyFile struct {
+	Roles map[string]struct {
+		Permissions []string `yaml:"permissions"`
+		Inherits    []string `yaml:"inherits"`
+	} `yaml:"roles"`
+}
+
+// NewPolicy creates a policy granting the given permissions to each role
+func NewPolicy(roles map[string][]string) *Policy {
+	p := &Policy{roles: make(map[string][]string, len(roles))}
+	for role, permissions := range roles {
+		p.roles[role] = slices.Clone(permissions)
+	}
+	return p
+}
+
+// LoadPolicy reads a YAML policy file
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %w", err)
+	}
+	var file policyFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to parse policy %s: %w", path, err)
+	}
+	if len(file.Roles) == 0 {
+		return nil, fmt.Errorf("policy %s defines no roles", path)
+	}
+	roles := make(map[string][]string, len(file.Roles))
+	// resolve collects the permissions of a role and of the roles it inherits from
+	var resolve func(role string, visiting []string) ([]string, error)
+	resolve = func(role string, visiting []string) ([]string, error) {
+		if slices.Contains(visiting, role) {
+			return nil, fmt.Errorf("role %q inherits from itself", role)
+		}
+		def, ok := file.Roles[role]
+		if !ok {
+			return nil, fmt.Errorf("unknown role %q", role)
+		}
+		permissions := slices.Clone(def.Permissions)
+		for _, parent := range def.Inherits {
+			inherited, err := resolve(parent, append(visiting, role))
+			if err != nil {
+				return nil, err
+			}
+			permissions = append(permissions, inherited...)
+		}
+		return permissions, nil
+	}
+	for role := range file.Roles {
+		permissions, err := resolve(role, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy %s: %w", path, err)
+		}
+		sort.Strings(permissions)
+		roles[role] = slices.Compact(permissions)
+	}
+	return &Policy{roles: roles}, nil
+}
+
+// HasRole reports whether the role is defined
+func (p *Policy) HasRole(role string) bool {
+	_, ok := p.roles[role]
+	return ok
+}
+
+// Roles returns the defined roles in alphabetical order
+func (p *Policy) Roles() []string {
+	roles := make([]string, 0, len(p.roles))
+	for role := range p.roles {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// Permissions returns the permissions granted to the role
+func (p *Policy) Permissions(role string) []string {
+	return slices.Clone(p.roles[role])
+}
+
+// Allows reports whether the role is granted the permission
+func (p *Policy) Allows(role, permission string) bool {
+	return Grants(p.roles[role], permission)
+}
+
+// Grants reports whether the granted permissions include the permission, directly or through a wildcard
+func Grants(granted []string, permission string) bool {
+	for _, g := range granted {
+		if g == permission {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(g, "*"); ok && strings.HasPrefix(permission, prefix) {
+			return true
+		}
+	}
+	return false
+}
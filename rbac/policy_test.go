@@ -0,0 +1,125 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package rbac
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGrants(t *testing.T) {
+	for _, tc := range []struct {
+		granted    []string
+		permission string
+		want       bool
+	}{
+		{nil, BooksRead, false},
+		{[]string{}, "", false},
+		{[]string{BooksRead}, BooksRead, true},
+		{[]string{BooksRead}, BooksWrite, false},
+		// Permissions are matched exactly, a shared prefix grants nothing without a wildcard
+		{[]string{"books"}, BooksRead, false},
+		{[]string{"books:read"}, "books:read:all", false},
+		{[]string{"books:*"}, BooksDelete, true},
+		{[]string{"books:*"}, UsersAdmin, false},
+		{[]string{"books*"}, "booksellers:admin", true},
+		{[]string{"*"}, APIKeysAdmin, true},
+	} {
+		if got := Grants(tc.granted, tc.permission); got != tc.want {
+			t.Errorf("Grants(%v, %q) = %t, want %t", tc.granted, tc.permission, got, tc.want)
+		}
+	}
+}
+
+func TestPolicyDenyByDefault(t *testing.T) {
+	p := NewPolicy(map[string][]string{"user": {BooksRead}, "guest": nil})
+	for _, tc := range []struct {
+		role, permission string
+		want             bool
+	}{
+		{"user", BooksRead, true},
+		{"user", BooksWrite, false},
+		{"guest", BooksRead, false},
+		{"unknown", BooksRead, false},
+		{"", BooksRead, false},
+	} {
+		if got := p.Allows(tc.role, tc.permission); got != tc.want {
+			t.Errorf("Allows(%q, %q) = %t, want %t", tc.role, tc.permission, got, tc.want)
+		}
+	}
+	if p.HasRole("unknown") || len(p.Permissions("unknown")) != 0 {
+		t.Error("an undefined role is known or granted permissions")
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	p, err := LoadPolicy(filepath.Join("..", "data", "policy.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roles := p.Roles(); !slices.Equal(roles, []string{"admin", "user"}) {
+		t.Errorf("Roles() = %v, want [admin user]", roles)
+	}
+	// admin inherits the permissions of user
+	for _, permission := range []string{BooksRead, BooksWrite, BooksDelete, BooksAny, UsersAdmin, APIKeysAdmin} {
+		if !p.Allows("admin", permission) {
+			t.Errorf("admin is not granted %s", permission)
+		}
+	}
+	for _, permission := range []string{BooksDelete, BooksAny, UsersAdmin, KeysAdmin, APIKeysAdmin} {
+		if p.Allows("user", permission) {
+			t.Errorf("user is granted %s", permission)
+		}
+	}
+}
+
+func TestLoadPolicyErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		policy string
+		want   string
+	}{
+		"no roles":          {"roles: {}\n", "defines no roles"},
+		"unknown field":     {"roles:\n  user:\n    permission: [books:read]\n", "field permission not found"},
+		"unknown parent":    {"roles:\n  user:\n    inherits: [guest]\n", `unknown role "guest"`},
+		"inheritance cycle": {"roles:\n  a:\n    inherits: [b]\n  b:\n    inherits: [a]\n", "inherits from itself"},
+		"invalid YAML":      {"roles: [\n", "failed to parse"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "policy.yaml")
+			if err := os.WriteFile(path, []byte(tc.policy), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadPolicy(path); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("LoadPolicy() error = %v, want %q", err, tc.want)
+			}
+		})
+	}
+	if _, err := LoadPolicy(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("LoadPolicy() of a missing file succeeded")
+	}
+}
@@ -0,0 +1,228 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package repositories
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/okapi-example/models"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrAPIKeyNotFound is returned when an API key does not exist
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// touchWriteInterval is how often FileAPIKeyStore writes the last uses of the keys
+const touchWriteInterval = time.Minute
+
+// APIKeyStore keeps the API keys of services, identified by the public ID embedded in the key
+type APIKeyStore interface {
+	// List returns all keys, newest first
+	List() ([]*models.APIKey, error)
+	// Get returns the key with the given ID, or ErrAPIKeyNotFound
+	Get(id string) (*models.APIKey, error)
+	// Create stores a new key
+	Create(key *models.APIKey) error
+	// Touch records that the key was used at the given time
+	Touch(id string, usedAt time.Time) error
+	// Revoke invalidates the key, or returns ErrAPIKeyNotFound
+	Revoke(id string) error
+}
+
+// InMemoryAPIKeyStore keeps API keys in memory, it is safe for concurrent use
+type InMemoryAPIKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]*models.APIKey
+}
+
+// NewInMemoryAPIKeyStore creates an API key store holding the given keys
+func NewInMemoryAPIKeyStore(keys ...*models.APIKey) *InMemoryAPIKeyStore {
+	s := &InMemoryAPIKeyStore{keys: make(map[string]*models.APIKey, len(keys))}
+	for _, key := range keys {
+		s.keys[key.ID] = cloneAPIKey(key)
+	}
+	return s
+}
+
+func (s *InMemoryAPIKeyStore) List() ([]*models.APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]*models.APIKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, cloneAPIKey(key))
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (s *InMemoryAPIKeyStore) Get(id string) (*models.APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	return cloneAPIKey(key), nil
+}
+
+func (s *InMemoryAPIKeyStore) Create(key *models.APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now()
+	}
+	s.keys[key.ID] = cloneAPIKey(key)
+	return nil
+}
+
+func (s *InMemoryAPIKeyStore) Touch(id string, usedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[id]
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+	key.LastUsedAt = usedAt
+	return nil
+}
+
+func (s *InMemoryAPIKeyStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[id]
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+	key.Revoked = true
+	return nil
+}
+
+// restore puts back the previous version of a key after a failed change, nil removes the key
+func (s *InMemoryAPIKeyStore) restore(id string, previous *models.APIKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if previous == nil {
+		delete(s.keys, id)
+		return
+	}
+	s.keys[id] = previous
+}
+
+func cloneAPIKey(key *models.APIKey) *models.APIKey {
+	c := *key
+	c.Permissions = slices.Clone(key.Permissions)
+	return &c
+}
+
+// FileAPIKeyStore keeps API keys in memory and writes every change to a JSON file
+type FileAPIKeyStore struct {
+	*InMemoryAPIKeyStore
+	path string
+	// changeMu serializes changes, so that a failed change is undone before the next one is written
+	changeMu sync.Mutex
+	// touchWrittenAt is when uses of the keys were last written
+	touchWrittenAt time.Time
+}
+
+// NewFileAPIKeyStore loads the API keys stored in path, a missing file starts an empty store
+func NewFileAPIKeyStore(path string) (*FileAPIKeyStore, error) {
+	var keys []*models.APIKey
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read API keys data: %w", err)
+	default:
+		if err = json.Unmarshal(data, &keys); err != nil {
+			return nil, fmt.Errorf("failed to parse API keys data: %w", err)
+		}
+		logger.Info("API keys loaded", "file", path, "count", len(keys))
+	}
+	return &FileAPIKeyStore{InMemoryAPIKeyStore: NewInMemoryAPIKeyStore(keys...), path: path}, nil
+}
+
+func (s *FileAPIKeyStore) Create(key *models.APIKey) error {
+	return s.change(key.ID, func() error {
+		return s.InMemoryAPIKeyStore.Create(key)
+	})
+}
+
+// Touch records the use of the key in memory. Uses are only informational and frequent,
+// they are written at most once per touchWriteInterval, or with the next change of a key.
+func (s *FileAPIKeyStore) Touch(id string, usedAt time.Time) error {
+	if err := s.InMemoryAPIKeyStore.Touch(id, usedAt); err != nil {
+		return err
+	}
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+	if usedAt.Sub(s.touchWrittenAt) < touchWriteInterval {
+		return nil
+	}
+	s.touchWrittenAt = usedAt
+	return s.write()
+}
+
+func (s *FileAPIKeyStore) Revoke(id string) error {
+	return s.change(id, func() error {
+		return s.InMemoryAPIKeyStore.Revoke(id)
+	})
+}
+
+// change applies a change of the key in memory and writes the keys,
+// the key is restored when the write fails so that a key revoked in memory is not valid again after a restart
+func (s *FileAPIKeyStore) change(id string, apply func() error) error {
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+	previous, err := s.Get(id)
+	if err != nil && !errors.Is(err, ErrAPIKeyNotFound) {
+		return err
+	}
+	if err = apply(); err != nil {
+		return err
+	}
+	if err = s.write(); err != nil {
+		s.restore(id, previous)
+		return err
+	}
+	return nil
+}
+
+func (s *FileAPIKeyStore) write() error {
+	keys, err := s.List()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode API keys data: %w", err)
+	}
+	return writeFileAtomic(s.path, data, true)
+}
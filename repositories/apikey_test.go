@@ -0,0 +1,130 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package repositories
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jkaninda/okapi-example/models"
+)
+
+func TestFileAPIKeyStoreRollback(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "api-keys.json")
+	store, err := NewFileAPIKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Create(&models.APIKey{ID: "key1", Name: "import"}); err != nil {
+		t.Fatal(err)
+	}
+	// Writes fail once the directory is replaced by a file
+	if err = os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(dir, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.Revoke("key1"); err == nil {
+		t.Error("Revoke() succeeded without writing the file")
+	}
+	if err = store.Create(&models.APIKey{ID: "key2", Name: "export"}); err == nil {
+		t.Error("Create() succeeded without writing the file")
+	}
+	// The revocation is not in effect until it is written, the key would be valid again after a restart
+	key, err := store.Get("key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Revoked {
+		t.Error("key1 is revoked in memory but not in the file")
+	}
+	if _, err = store.Get("key2"); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("Get(key2) error = %v, want ErrAPIKeyNotFound after the failed create", err)
+	}
+}
+
+func TestFileAPIKeyStoreTouch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api-keys.json")
+	store, err := NewFileAPIKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Create(&models.APIKey{ID: "key1"}); err != nil {
+		t.Fatal(err)
+	}
+	stored := func() time.Time {
+		t.Helper()
+		reloaded, err := NewFileAPIKeyStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := reloaded.Get("key1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key.LastUsedAt
+	}
+
+	first := time.Now()
+	if err = store.Touch("key1", first); err != nil {
+		t.Fatal(err)
+	}
+	if got := stored(); !got.Equal(first) {
+		t.Errorf("stored LastUsedAt = %v, want the first use %v", got, first)
+	}
+	// Uses within the interval are only kept in memory
+	if err = store.Touch("key1", first.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got := stored(); !got.Equal(first) {
+		t.Errorf("stored LastUsedAt = %v, want the first use %v", got, first)
+	}
+	key, err := store.Get("key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.LastUsedAt.Equal(first.Add(time.Second)) {
+		t.Errorf("LastUsedAt = %v, want the last use", key.LastUsedAt)
+	}
+	later := first.Add(touchWriteInterval)
+	if err = store.Touch("key1", later); err != nil {
+		t.Fatal(err)
+	}
+	if got := stored(); !got.Equal(later) {
+		t.Errorf("stored LastUsedAt = %v, want %v once the interval has passed", got, later)
+	}
+	if err = store.Touch("unknown", later); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("Touch(unknown) error = %v, want ErrAPIKeyNotFound", err)
+	}
+}
@@ -0,0 +1,249 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package repositories
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/okapi-example/models"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrBookNotFound is returned when a book with the requested ID does not exist
+	ErrBookNotFound = errors.New("book not found")
+	// ErrBookExists is returned when creating a book with an ID that is already taken
+	ErrBookExists = errors.New("book already exists")
+	// ErrBookModified is returned when a book was changed since the version the caller read
+	ErrBookModified = errors.New("book was modified since it was read")
+)
+
+// BookRepository abstracts the storage of books used by the BookController
+type BookRepository interface {
+	// List returns all books
+	List() ([]*models.Book, error)
+	// Find returns the page of books selected by the filter and the total number of matching books
+	Find(filter BookFilter) ([]*models.Book, int, error)
+	// Get returns the book with the given ID, or ErrBookNotFound
+	Get(id int) (*models.Book, error)
+	// Create stores a new book, assigns its ID when it is zero and sets its timestamps
+	Create(book *models.Book) error
+	// Update replaces an existing book, keeping its CreatedAt and OwnerID and refreshing UpdatedAt,
+	// or returns ErrBookNotFound. A non-zero version must be the UpdatedAt of the stored book, or ErrBookModified is returned.
+	Update(book *models.Book, version time.Time) error
+	// Delete removes the book with the given ID, or returns ErrBookNotFound.
+	// A non-zero version must be the UpdatedAt of the stored book, or ErrBookModified is returned.
+	Delete(id int, version time.Time) error
+	// Count returns the number of stored books
+	Count() (int, error)
+}
+
+// InMemoryBookRepository keeps books in memory.
+// It is safe for concurrent use; books are copied on the way in and out
+// so callers never share pointers with the store.
+type InMemoryBookRepository struct {
+	mu     sync.RWMutex
+	books  map[int]*models.Book
+	lastId int
+}
+
+// NewInMemoryBookRepository creates an in-memory repository holding the given books.
+// The ID sequence starts after the highest existing ID.
+func NewInMemoryBookRepository(books ...*models.Book) *InMemoryBookRepository {
+	r := &InMemoryBookRepository{books: make(map[int]*models.Book, len(books))}
+	for _, book := range books {
+		_ = r.Create(book)
+	}
+	return r
+}
+
+func (r *InMemoryBookRepository) List() ([]*models.Book, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	books := make([]*models.Book, 0, len(r.books))
+	for _, book := range r.books {
+		b := *book
+		books = append(books, &b)
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].Id < books[j].Id })
+	return books, nil
+}
+
+func (r *InMemoryBookRepository) Find(filter BookFilter) ([]*models.Book, int, error) {
+	books, err := r.List()
+	if err != nil {
+		return nil, 0, err
+	}
+	page, total := filter.apply(books)
+	return page, total, nil
+}
+
+func (r *InMemoryBookRepository) Get(id int) (*models.Book, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	book, ok := r.books[id]
+	if !ok {
+		return nil, ErrBookNotFound
+	}
+	b := *book
+	return &b, nil
+}
+
+// Create stores a copy of the book. A zero ID is allocated from the sequence,
+// an explicit ID is kept and advances the sequence past it.
+func (r *InMemoryBookRepository) Create(book *models.Book) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if book.Id == 0 {
+		r.lastId++
+		book.Id = r.lastId
+	} else if _, exists := r.books[book.Id]; exists {
+		return ErrBookExists
+	} else if book.Id > r.lastId {
+		r.lastId = book.Id
+	}
+	stampCreated(book, time.Now())
+	b := *book
+	r.books[b.Id] = &b
+	return nil
+}
+
+func (r *InMemoryBookRepository) Update(book *models.Book, version time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	existing, ok := r.books[book.Id]
+	if !ok {
+		return ErrBookNotFound
+	}
+	if !unmodified(existing, version) {
+		return ErrBookModified
+	}
+	stampUpdated(book, existing, time.Now())
+	b := *book
+	r.books[b.Id] = &b
+	return nil
+}
+
+func (r *InMemoryBookRepository) Delete(id int, version time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	existing, ok := r.books[id]
+	if !ok {
+		return ErrBookNotFound
+	}
+	if !unmodified(existing, version) {
+		return ErrBookModified
+	}
+	delete(r.books, id)
+	return nil
+}
+
+func (r *InMemoryBookRepository) Count() (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.books), nil
+}
+
+// restore puts back the previous version of a book after a failed change, nil removes the book.
+// The ID sequence is left as is, IDs are never reused.
+func (r *InMemoryBookRepository) restore(id int, previous *models.Book) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if previous == nil {
+		delete(r.books, id)
+		return
+	}
+	b := *previous
+	r.books[id] = &b
+}
+
+// stampCreated fills in missing creation timestamps, seeded books keep their own
+func stampCreated(book *models.Book, now time.Time) {
+	if book.CreatedAt.IsZero() {
+		book.CreatedAt = now
+	}
+	if book.UpdatedAt.IsZero() {
+		book.UpdatedAt = book.CreatedAt
+	}
+}
+
+// stampUpdated preserves the original creation date and owner, and refreshes the update date
+func stampUpdated(book, existing *models.Book, now time.Time) {
+	book.CreatedAt = existing.CreatedAt
+	book.OwnerID = existing.OwnerID
+	book.UpdatedAt = now
+}
+
+// unmodified reports whether the book is at the given version, the zero version matches any book
+func unmodified(book *models.Book, version time.Time) bool {
+	return version.IsZero() || book.UpdatedAt.Equal(version)
+}
+
+// batchCreator is implemented by repositories storing several books at once, all or none
+type batchCreator interface {
+	CreateAll(books []*models.Book) error
+}
+
+// SeedFromFile loads books from a JSON file and stores them in the repository.
+// Repositories implementing CreateAll store all of them or none.
+func SeedFromFile(repo BookRepository, path string) error {
+	books, err := readBooksFromFile(path)
+	if err != nil {
+		return err
+	}
+	if batch, ok := repo.(batchCreator); ok {
+		if err = batch.CreateAll(books); err != nil {
+			return fmt.Errorf("failed to seed books: %w", err)
+		}
+	} else {
+		for _, book := range books {
+			if err = repo.Create(book); err != nil {
+				return fmt.Errorf("failed to seed book %d: %w", book.Id, err)
+			}
+		}
+	}
+	logger.Info("Books loaded", "file", path, "count", len(books))
+	return nil
+}
+
+func readBooksFromFile(path string) ([]*models.Book, error) {
+	booksFile, err := os.ReadFile(path)
+	if err != nil {
+		logger.Error("Error reading books file", "error", err)
+		return nil, fmt.Errorf("failed to read books data: %w", err)
+	}
+	var books []*models.Book
+	err = json.Unmarshal(booksFile, &books)
+	if err != nil {
+		logger.Error("Error unmarshalling books data", "error", err)
+		return nil, fmt.Errorf("failed to parse books data: %w", err)
+	}
+	return books, nil
+}
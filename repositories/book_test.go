@@ -0,0 +1,167 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package repositories
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jkaninda/okapi-example/models"
+)
+
+// TestInMemoryBookRepositoryConcurrentAccess runs creates, reads and listings in parallel, run it with -race
+func TestInMemoryBookRepositoryConcurrentAccess(t *testing.T) {
+	repo := NewInMemoryBookRepository(&models.Book{Id: 1, Title: "Seed"})
+	const writers, perWriter = 8, 50
+
+	var wg sync.WaitGroup
+	ids := make(chan int, writers*perWriter)
+	errs := make(chan error, writers*perWriter*3)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				book := &models.Book{Title: fmt.Sprintf("Book %d-%d", w, i)}
+				if err := repo.Create(book); err != nil {
+					errs <- err
+					continue
+				}
+				ids <- book.Id
+				// The caller's copy is not shared with the store
+				book.Title = "changed by the caller"
+				stored, err := repo.Get(book.Id)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				if stored.Title != fmt.Sprintf("Book %d-%d", w, i) {
+					errs <- fmt.Errorf("book %d has title %q", book.Id, stored.Title)
+				}
+				if _, err = repo.List(); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(ids)
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	seen := make(map[int]bool)
+	for id := range ids {
+		if id <= 1 {
+			t.Errorf("allocated ID %d does not follow the seeded ID 1", id)
+		}
+		if seen[id] {
+			t.Errorf("ID %d allocated twice", id)
+		}
+		seen[id] = true
+	}
+	count, err := repo.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := writers*perWriter + 1; count != want {
+		t.Errorf("Count() = %d, want %d", count, want)
+	}
+	books, err := repo.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(books); i++ {
+		if books[i-1].Id >= books[i].Id {
+			t.Fatalf("List() is not ordered by ID: %d before %d", books[i-1].Id, books[i].Id)
+		}
+	}
+}
+
+func TestInMemoryBookRepositoryMonotonicIDs(t *testing.T) {
+	repo := NewInMemoryBookRepository(&models.Book{Id: 5, Title: "Seed"})
+	create := func(id int) *models.Book {
+		t.Helper()
+		book := &models.Book{Id: id, Title: "Book"}
+		if err := repo.Create(book); err != nil {
+			t.Fatalf("Create(id %d) error = %v", id, err)
+		}
+		return book
+	}
+
+	if got := create(0).Id; got != 6 {
+		t.Errorf("first allocated ID = %d, want 6", got)
+	}
+	// An explicit ID advances the sequence past it
+	create(10)
+	if got := create(0).Id; got != 11 {
+		t.Errorf("ID after explicit 10 = %d, want 11", got)
+	}
+	// A lower explicit ID does not move the sequence back
+	create(3)
+	if got := create(0).Id; got != 12 {
+		t.Errorf("ID after explicit 3 = %d, want 12", got)
+	}
+	// Deleted IDs are never reused
+	if err := repo.Delete(12, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := create(0).Id; got != 13 {
+		t.Errorf("ID after deleting 12 = %d, want 13", got)
+	}
+	if err := repo.Create(&models.Book{Id: 10}); !errors.Is(err, ErrBookExists) {
+		t.Errorf("Create(existing ID) error = %v, want ErrBookExists", err)
+	}
+}
+
+func TestInMemoryBookRepositoryVersion(t *testing.T) {
+	repo := NewInMemoryBookRepository()
+	book := &models.Book{Title: "Book"}
+	if err := repo.Create(book); err != nil {
+		t.Fatal(err)
+	}
+	version := book.UpdatedAt
+
+	stale := version.Add(-time.Second)
+	if err := repo.Update(&models.Book{Id: book.Id, Title: "Stale"}, stale); !errors.Is(err, ErrBookModified) {
+		t.Errorf("Update(stale version) error = %v, want ErrBookModified", err)
+	}
+	if err := repo.Update(&models.Book{Id: book.Id, Title: "Current"}, version); err != nil {
+		t.Errorf("Update(current version) error = %v", err)
+	}
+	if err := repo.Delete(book.Id, version); !errors.Is(err, ErrBookModified) {
+		t.Errorf("Delete(previous version) error = %v, want ErrBookModified", err)
+	}
+	if err := repo.Delete(book.Id, time.Time{}); err != nil {
+		t.Errorf("Delete(any version) error = %v", err)
+	}
+	if err := repo.Delete(book.Id, time.Time{}); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("Delete(deleted) error = %v, want ErrBookNotFound", err)
+	}
+}
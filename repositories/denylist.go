@@ -0,0 +1,82 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package repositories
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenDenylist records revoked access tokens by their `jti` claim until they expire
+type TokenDenylist interface {
+	// Revoke denies the token until expiresAt, after which it is rejected as expired anyway
+	Revoke(jti string, expiresAt time.Time) error
+	// IsRevoked reports whether the token has been revoked
+	IsRevoked(jti string) (bool, error)
+}
+
+// InMemoryTokenDenylist keeps revoked tokens in memory and evicts them once expired,
+// it is safe for concurrent use
+type InMemoryTokenDenylist struct {
+	mu        sync.RWMutex
+	revoked   map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewInMemoryTokenDenylist creates an empty denylist
+func NewInMemoryTokenDenylist() *InMemoryTokenDenylist {
+	return &InMemoryTokenDenylist{revoked: make(map[string]time.Time), lastSweep: time.Now()}
+}
+
+func (d *InMemoryTokenDenylist) Revoke(jti string, expiresAt time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sweep()
+	if current, ok := d.revoked[jti]; !ok || expiresAt.After(current) {
+		d.revoked[jti] = expiresAt
+	}
+	return nil
+}
+
+func (d *InMemoryTokenDenylist) IsRevoked(jti string) (bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	expiresAt, ok := d.revoked[jti]
+	return ok && time.Now().Before(expiresAt), nil
+}
+
+// sweep evicts the entries of tokens that have expired
+func (d *InMemoryTokenDenylist) sweep() {
+	now := time.Now()
+	if now.Sub(d.lastSweep) < sweepInterval {
+		return
+	}
+	d.lastSweep = now
+	for jti, expiresAt := range d.revoked {
+		if now.After(expiresAt) {
+			delete(d.revoked, jti)
+		}
+	}
+}
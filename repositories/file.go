@@ -0,0 +1,214 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package repositories
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/okapi-example/models"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileOptions configures a FileBookRepository
+type FileOptions struct {
+	// Debounce delays writes so that bursts of changes are flushed once.
+	// Zero writes the file on every change.
+	Debounce time.Duration
+	// Fsync flushes the file and its directory to stable storage after each write
+	Fsync bool
+}
+
+// FileBookRepository keeps books in memory and writes them back to a JSON file.
+// Writes go to a temporary file which is then renamed over the original,
+// so readers never observe a truncated file. A change whose write fails is undone in memory,
+// unless writes are debounced, in which case the change is kept and written by the next flush.
+type FileBookRepository struct {
+	*InMemoryBookRepository
+	path    string
+	options FileOptions
+
+	// changeMu serializes changes, so that a failed change is undone before the next one is written
+	changeMu sync.Mutex
+	// writeMu serializes file writes
+	writeMu sync.Mutex
+	// timerMu guards timer
+	timerMu sync.Mutex
+	timer   *time.Timer
+}
+
+// NewFileBookRepository loads the books stored in path
+func NewFileBookRepository(path string, options FileOptions) (*FileBookRepository, error) {
+	books, err := readBooksFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Books loaded", "file", path, "count", len(books))
+	return &FileBookRepository{
+		InMemoryBookRepository: NewInMemoryBookRepository(books...),
+		path:                   path,
+		options:                options,
+	}, nil
+}
+
+func (r *FileBookRepository) Create(book *models.Book) error {
+	r.changeMu.Lock()
+	defer r.changeMu.Unlock()
+	if err := r.InMemoryBookRepository.Create(book); err != nil {
+		return err
+	}
+	if err := r.changed(); err != nil {
+		r.restore(book.Id, nil)
+		return err
+	}
+	return nil
+}
+
+func (r *FileBookRepository) Update(book *models.Book, version time.Time) error {
+	r.changeMu.Lock()
+	defer r.changeMu.Unlock()
+	previous, err := r.Get(book.Id)
+	if err != nil {
+		return err
+	}
+	if err = r.InMemoryBookRepository.Update(book, version); err != nil {
+		return err
+	}
+	if err = r.changed(); err != nil {
+		r.restore(book.Id, previous)
+		return err
+	}
+	return nil
+}
+
+func (r *FileBookRepository) Delete(id int, version time.Time) error {
+	r.changeMu.Lock()
+	defer r.changeMu.Unlock()
+	previous, err := r.Get(id)
+	if err != nil {
+		return err
+	}
+	if err = r.InMemoryBookRepository.Delete(id, version); err != nil {
+		return err
+	}
+	if err = r.changed(); err != nil {
+		r.restore(id, previous)
+		return err
+	}
+	return nil
+}
+
+// Flush writes pending changes to the file immediately
+func (r *FileBookRepository) Flush() error {
+	r.timerMu.Lock()
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	r.timerMu.Unlock()
+	return r.write()
+}
+
+// Close flushes pending changes
+func (r *FileBookRepository) Close() error {
+	return r.Flush()
+}
+
+// changed persists the books now, or schedules a write when debouncing
+func (r *FileBookRepository) changed() error {
+	if r.options.Debounce <= 0 {
+		return r.write()
+	}
+	r.timerMu.Lock()
+	defer r.timerMu.Unlock()
+	if r.timer == nil {
+		r.timer = time.AfterFunc(r.options.Debounce, func() {
+			r.timerMu.Lock()
+			r.timer = nil
+			r.timerMu.Unlock()
+			if err := r.write(); err != nil {
+				logger.Error("Error writing books file", "file", r.path, "error", err)
+			}
+		})
+	}
+	return nil
+}
+
+func (r *FileBookRepository) write() error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	books, err := r.List()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(books, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode books data: %w", err)
+	}
+	return writeFileAtomic(r.path, data, r.options.Fsync)
+}
+
+// writeFileAtomic replaces the file at path with data.
+// The data is written to a temporary file in the same directory which is then renamed over path.
+func writeFileAtomic(path string, data []byte, fsync bool) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	// Remove the temporary file if anything goes wrong before the rename
+	defer os.Remove(tmp.Name())
+	// Keep the permissions of the original file
+	if info, err := os.Stat(path); err == nil {
+		_ = tmp.Chmod(info.Mode().Perm())
+	}
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write data: %w", err)
+	}
+	if fsync {
+		if err = tmp.Sync(); err != nil {
+			_ = tmp.Close()
+			return fmt.Errorf("failed to sync data: %w", err)
+		}
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	if fsync {
+		// Persist the rename itself
+		if d, err := os.Open(dir); err == nil {
+			_ = d.Sync()
+			_ = d.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package repositories
+
+import (
+	"github.com/jkaninda/okapi-example/models"
+	"github.com/jkaninda/okapi-example/search"
+	"io"
+	"time"
+)
+
+// IndexedBookRepository keeps a search index in sync with the books of the wrapped repository
+type IndexedBookRepository struct {
+	BookRepository
+	index *search.Index
+}
+
+// NewIndexedBookRepository indexes the books stored in repo and wraps it
+// so that later changes are reflected in the index
+func NewIndexedBookRepository(repo BookRepository, index *search.Index) (*IndexedBookRepository, error) {
+	books, err := repo.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, book := range books {
+		index.Add(*book)
+	}
+	return &IndexedBookRepository{BookRepository: repo, index: index}, nil
+}
+
+func (r *IndexedBookRepository) Create(book *models.Book) error {
+	if err := r.BookRepository.Create(book); err != nil {
+		return err
+	}
+	r.index.Add(*book)
+	return nil
+}
+
+func (r *IndexedBookRepository) Update(book *models.Book, version time.Time) error {
+	if err := r.BookRepository.Update(book, version); err != nil {
+		return err
+	}
+	r.index.Add(*book)
+	return nil
+}
+
+func (r *IndexedBookRepository) Delete(id int, version time.Time) error {
+	if err := r.BookRepository.Delete(id, version); err != nil {
+		return err
+	}
+	r.index.Remove(id)
+	return nil
+}
+
+// Close closes the wrapped repository when it holds resources
+func (r *IndexedBookRepository) Close() error {
+	if closer, ok := r.BookRepository.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package repositories
+
+import (
+	"cmp"
+	"fmt"
+	"github.com/jkaninda/okapi-example/models"
+	"slices"
+	"strings"
+)
+
+// BookFilter selects, orders and paginates books.
+// Zero values disable the corresponding criterion.
+type BookFilter struct {
+	// Author matches books whose author contains the value, case-insensitively
+	Author string
+	// Country matches books from the given country, case-insensitively
+	Country string
+	// Language matches books written in the given language, case-insensitively
+	Language string
+	MinYear  int
+	MaxYear  int
+	MinPrice int
+	MaxPrice int
+	// Sort orders the result, books are ordered by ID when empty
+	Sort   []SortField
+	Offset int
+	// Limit caps the number of returned books, zero returns all of them
+	Limit int
+}
+
+// SortField orders books by a field
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// bookSortColumns maps the sortable JSON field names to their SQL columns
+var bookSortColumns = map[string]string{
+	"id":        "id",
+	"title":     "title COLLATE NOCASE",
+	"price":     "price",
+	"year":      "year",
+	"author":    "author COLLATE NOCASE",
+	"country":   "country COLLATE NOCASE",
+	"language":  "language COLLATE NOCASE",
+	"pages":     "pages",
+	"createdAt": "julianday(created_at)",
+	"updatedAt": "julianday(updated_at)",
+}
+
+// ParseSort parses a comma-separated list of fields, prefixed with "-" for descending order,
+// e.g. "price,-year"
+func ParseSort(sort string) ([]SortField, error) {
+	var fields []SortField
+	for _, part := range strings.Split(sort, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		field := SortField{Field: strings.TrimPrefix(part, "-"), Desc: strings.HasPrefix(part, "-")}
+		if _, ok := bookSortColumns[field.Field]; !ok {
+			return nil, fmt.Errorf("unsupported sort field %q", field.Field)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// matches reports whether the book satisfies the filter criteria
+func (f BookFilter) matches(book *models.Book) bool {
+	if f.Author != "" && !strings.Contains(strings.ToLower(book.Author), strings.ToLower(f.Author)) {
+		return false
+	}
+	if f.Country != "" && !strings.EqualFold(book.Country, f.Country) {
+		return false
+	}
+	if f.Language != "" && !strings.EqualFold(book.Language, f.Language) {
+		return false
+	}
+	if (f.MinYear != 0 && book.Year < f.MinYear) || (f.MaxYear != 0 && book.Year > f.MaxYear) {
+		return false
+	}
+	if (f.MinPrice != 0 && book.Price < f.MinPrice) || (f.MaxPrice != 0 && book.Price > f.MaxPrice) {
+		return false
+	}
+	return true
+}
+
+// apply filters, sorts and paginates books in memory, returning the page and the total number of matches
+func (f BookFilter) apply(books []*models.Book) ([]*models.Book, int) {
+	matched := make([]*models.Book, 0, len(books))
+	for _, book := range books {
+		if f.matches(book) {
+			matched = append(matched, book)
+		}
+	}
+	slices.SortStableFunc(matched, func(a, b *models.Book) int {
+		for _, field := range f.Sort {
+			c := compareBooks(a, b, field.Field)
+			if field.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return cmp.Compare(a.Id, b.Id)
+	})
+	total := len(matched)
+	start := max(0, min(f.Offset, total))
+	end := total
+	if f.Limit > 0 {
+		end = min(start+f.Limit, total)
+	}
+	return matched[start:end], total
+}
+
+func compareBooks(a, b *models.Book, field string) int {
+	switch field {
+	case "title":
+		return compareFold(a.Title, b.Title)
+	case "price":
+		return cmp.Compare(a.Price, b.Price)
+	case "year":
+		return cmp.Compare(a.Year, b.Year)
+	case "author":
+		return compareFold(a.Author, b.Author)
+	case "country":
+		return compareFold(a.Country, b.Country)
+	case "language":
+		return compareFold(a.Language, b.Language)
+	case "pages":
+		return cmp.Compare(a.Pages, b.Pages)
+	case "createdAt":
+		return a.CreatedAt.Compare(b.CreatedAt)
+	case "updatedAt":
+		return a.UpdatedAt.Compare(b.UpdatedAt)
+	default:
+		return cmp.Compare(a.Id, b.Id)
+	}
+}
+
+func compareFold(a, b string) int {
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
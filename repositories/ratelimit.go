@@ -0,0 +1,108 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package repositories
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimitResult is the outcome of a request against a rate limit
+type RateLimitResult struct {
+	Allowed bool
+	// Remaining is the number of requests allowed right now after this one
+	Remaining int
+	// Reset is the time until the full quota is available again
+	Reset time.Duration
+	// RetryAfter is the time until the next request is allowed, when this one is not
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps the quotas of the clients, shared backends let several instances enforce the same limits
+type RateLimitStore interface {
+	// Allow takes a request from the quota of key, allowing limit requests per period
+	Allow(key string, limit int, period time.Duration) (RateLimitResult, error)
+}
+
+// InMemoryRateLimitStore implements RateLimitStore with token buckets kept in memory,
+// it is safe for concurrent use
+type InMemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// tokenBucket holds up to limit tokens, refilled continuously at limit per period
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket is full again, after which it can be dropped
+	full time.Time
+}
+
+// NewInMemoryRateLimitStore creates an empty store
+func NewInMemoryRateLimitStore() *InMemoryRateLimitStore {
+	return &InMemoryRateLimitStore{buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+func (s *InMemoryRateLimitStore) Allow(key string, limit int, period time.Duration) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+	// Time to refill one token
+	interval := period / time.Duration(limit)
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit), updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens = min(float64(limit), b.tokens+float64(now.Sub(b.updated))/float64(interval))
+	b.updated = now
+	result := RateLimitResult{Allowed: b.tokens >= 1}
+	if result.Allowed {
+		b.tokens--
+	} else {
+		result.RetryAfter = time.Duration((1 - b.tokens) * float64(interval))
+	}
+	result.Remaining = int(math.Floor(b.tokens))
+	result.Reset = time.Duration((float64(limit) - b.tokens) * float64(interval))
+	b.full = now.Add(result.Reset)
+	return result, nil
+}
+
+// sweep drops the buckets that are full again, they are recreated full when needed
+func (s *InMemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		if now.After(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+}
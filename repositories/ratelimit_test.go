@@ -0,0 +1,85 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package repositories
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInMemoryRateLimitStore(t *testing.T) {
+	s := NewInMemoryRateLimitStore()
+	const limit, period = 3, 3 * time.Second
+	allow := func(key string) RateLimitResult {
+		t.Helper()
+		result, err := s.Allow(key, limit, period)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	// near reports whether d is within the time the test takes of want
+	near := func(d, want time.Duration) bool {
+		return d <= want && d > want-100*time.Millisecond
+	}
+
+	// A new client starts with a full bucket
+	for i, remaining := range []int{2, 1, 0} {
+		result := allow("alice")
+		if !result.Allowed || result.Remaining != remaining {
+			t.Errorf("request %d = %+v, want allowed with %d remaining", i+1, result, remaining)
+		}
+	}
+	result := allow("alice")
+	if result.Allowed || result.Remaining != 0 {
+		t.Errorf("request beyond the limit = %+v, want rejected", result)
+	}
+	// One token is refilled every period / limit, the bucket is full after a whole period
+	if !near(result.RetryAfter, time.Second) || !near(result.Reset, period) {
+		t.Errorf("RetryAfter, Reset = %s, %s, want 1s, 3s", result.RetryAfter, result.Reset)
+	}
+	if result = allow("bob"); !result.Allowed || result.Remaining != limit-1 {
+		t.Errorf("request of another client = %+v, want its own quota", result)
+	}
+
+	// Refill one token
+	s.mu.Lock()
+	s.buckets["alice"].updated = s.buckets["alice"].updated.Add(-time.Second)
+	s.mu.Unlock()
+	if result = allow("alice"); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("request after a refill = %+v, want allowed with 0 remaining", result)
+	}
+	if result = allow("alice"); result.Allowed {
+		t.Errorf("second request after a refill of one token = %+v, want rejected", result)
+	}
+
+	// An idle client gets a full bucket back, never more
+	s.mu.Lock()
+	s.buckets["alice"].updated = s.buckets["alice"].updated.Add(-time.Hour)
+	s.mu.Unlock()
+	if result = allow("alice"); !result.Allowed || result.Remaining != limit-1 {
+		t.Errorf("request after an hour = %+v, want allowed with %d remaining", result, limit-1)
+	}
+}
@@ -0,0 +1,353 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package repositories
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/okapi-example/models"
+	"strings"
+	"time"
+
+	// Pure-Go SQLite driver, keeps CGO_ENABLED=0 builds working
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations holds the schema history, each entry is applied once in order.
+// Never edit an existing entry, append a new one instead.
+var sqliteMigrations = []string{
+	`CREATE TABLE books (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		title      TEXT    NOT NULL,
+		price      INTEGER NOT NULL DEFAULT 0,
+		year       INTEGER NOT NULL DEFAULT 0,
+		author     TEXT    NOT NULL DEFAULT '',
+		country    TEXT    NOT NULL DEFAULT '',
+		image_link TEXT    NOT NULL DEFAULT '',
+		language   TEXT    NOT NULL DEFAULT '',
+		link       TEXT    NOT NULL DEFAULT '',
+		pages      INTEGER NOT NULL DEFAULT 0,
+		created_at TEXT    NOT NULL,
+		updated_at TEXT    NOT NULL
+	)`,
+	`ALTER TABLE books ADD COLUMN owner_id TEXT NOT NULL DEFAULT ''`,
+}
+
+const bookColumns = "id, title, price, year, author, country, image_link, language, link, pages, created_at, updated_at, owner_id"
+
+// SQLiteBookRepository stores books in a SQLite database
+type SQLiteBookRepository struct {
+	db *sql.DB
+}
+
+// NewSQLiteBookRepository opens the SQLite database at path and applies pending migrations
+func NewSQLiteBookRepository(path string) (*SQLiteBookRepository, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+	// SQLite allows a single writer, serialize access instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	r := &SQLiteBookRepository{db: db}
+	if err = r.migrate(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close closes the underlying database
+func (r *SQLiteBookRepository) Close() error {
+	return r.db.Close()
+}
+
+func (r *SQLiteBookRepository) migrate() error {
+	_, err := r.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	var version int
+	err = r.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := r.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(sqliteMigrations[i]); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+		if _, err = tx.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)", i+1, formatTime(time.Now())); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %w", i+1, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		logger.Info("Applied database migration", "version", i+1)
+	}
+	return nil
+}
+
+func (r *SQLiteBookRepository) List() ([]*models.Book, error) {
+	rows, err := r.db.Query("SELECT " + bookColumns + " FROM books ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	books := make([]*models.Book, 0)
+	for rows.Next() {
+		book, err := scanBook(rows)
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, book)
+	}
+	return books, rows.Err()
+}
+
+func (r *SQLiteBookRepository) Find(filter BookFilter) ([]*models.Book, int, error) {
+	var where []string
+	var args []any
+	if filter.Author != "" {
+		where = append(where, "instr(lower(author), lower(?)) > 0")
+		args = append(args, filter.Author)
+	}
+	if filter.Country != "" {
+		where = append(where, "country = ? COLLATE NOCASE")
+		args = append(args, filter.Country)
+	}
+	if filter.Language != "" {
+		where = append(where, "language = ? COLLATE NOCASE")
+		args = append(args, filter.Language)
+	}
+	for _, bound := range []struct {
+		clause string
+		value  int
+	}{
+		{"year >= ?", filter.MinYear},
+		{"year <= ?", filter.MaxYear},
+		{"price >= ?", filter.MinPrice},
+		{"price <= ?", filter.MaxPrice},
+	} {
+		if bound.value != 0 {
+			where = append(where, bound.clause)
+			args = append(args, bound.value)
+		}
+	}
+	conditions := ""
+	if len(where) > 0 {
+		conditions = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total int
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM books"+conditions, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	var orderBy []string
+	for _, field := range filter.Sort {
+		column, ok := bookSortColumns[field.Field]
+		if !ok {
+			return nil, 0, fmt.Errorf("unsupported sort field %q", field.Field)
+		}
+		if field.Desc {
+			column += " DESC"
+		}
+		orderBy = append(orderBy, column)
+	}
+	orderBy = append(orderBy, "id")
+	limit := -1
+	if filter.Limit > 0 {
+		limit = filter.Limit
+	}
+	query := "SELECT " + bookColumns + " FROM books" + conditions +
+		" ORDER BY " + strings.Join(orderBy, ", ") + " LIMIT ? OFFSET ?"
+	rows, err := r.db.Query(query, append(args, limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	books := make([]*models.Book, 0)
+	for rows.Next() {
+		book, err := scanBook(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		books = append(books, book)
+	}
+	return books, total, rows.Err()
+}
+
+func (r *SQLiteBookRepository) Get(id int) (*models.Book, error) {
+	book, err := scanBook(r.db.QueryRow("SELECT "+bookColumns+" FROM books WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrBookNotFound
+	}
+	return book, err
+}
+
+func (r *SQLiteBookRepository) Create(book *models.Book) error {
+	return insertBook(r.db, book)
+}
+
+// CreateAll stores the books in a single transaction, none are stored when one fails
+func (r *SQLiteBookRepository) CreateAll(books []*models.Book) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	// Rolling back a committed transaction is a no-op
+	defer func() { _ = tx.Rollback() }()
+	for _, book := range books {
+		if err = insertBook(tx, book); err != nil {
+			return fmt.Errorf("failed to store book %d: %w", book.Id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// execer is implemented by *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func insertBook(db execer, book *models.Book) error {
+	stampCreated(book, time.Now())
+	// A NULL id lets SQLite allocate the next value of the AUTOINCREMENT sequence
+	var id any
+	if book.Id != 0 {
+		id = book.Id
+	}
+	res, err := db.Exec("INSERT INTO books ("+bookColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		id, book.Title, book.Price, book.Year, book.Author, book.Country, book.ImageLink,
+		book.Language, book.Link, book.Pages, formatTime(book.CreatedAt), formatTime(book.UpdatedAt), book.OwnerID)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrBookExists
+		}
+		return err
+	}
+	lastId, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	book.Id = int(lastId)
+	return nil
+}
+
+func (r *SQLiteBookRepository) Update(book *models.Book, version time.Time) error {
+	return r.change(book.Id, version, func(tx *sql.Tx, existing *models.Book) (sql.Result, error) {
+		stampUpdated(book, existing, time.Now())
+		return tx.Exec(`UPDATE books SET title = ?, price = ?, year = ?, author = ?, country = ?, image_link = ?,
+			language = ?, link = ?, pages = ?, created_at = ?, updated_at = ? WHERE id = ?`,
+			book.Title, book.Price, book.Year, book.Author, book.Country, book.ImageLink,
+			book.Language, book.Link, book.Pages, formatTime(book.CreatedAt), formatTime(book.UpdatedAt), book.Id)
+	})
+}
+
+func (r *SQLiteBookRepository) Delete(id int, version time.Time) error {
+	return r.change(id, version, func(tx *sql.Tx, _ *models.Book) (sql.Result, error) {
+		return tx.Exec("DELETE FROM books WHERE id = ?", id)
+	})
+}
+
+// change loads the book, checks its version and applies the statement of apply in a single transaction
+func (r *SQLiteBookRepository) change(id int, version time.Time, apply func(tx *sql.Tx, existing *models.Book) (sql.Result, error)) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	// Rolling back a committed transaction is a no-op
+	defer func() { _ = tx.Rollback() }()
+	existing, err := scanBook(tx.QueryRow("SELECT "+bookColumns+" FROM books WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrBookNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !unmodified(existing, version) {
+		return ErrBookModified
+	}
+	res, err := apply(tx, existing)
+	if err != nil {
+		return err
+	}
+	if err = requireAffected(res); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *SQLiteBookRepository) Count() (int, error) {
+	var count int
+	err := r.db.QueryRow("SELECT COUNT(*) FROM books").Scan(&count)
+	return count, err
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanBook(row rowScanner) (*models.Book, error) {
+	book := &models.Book{}
+	var createdAt, updatedAt string
+	err := row.Scan(&book.Id, &book.Title, &book.Price, &book.Year, &book.Author, &book.Country,
+		&book.ImageLink, &book.Language, &book.Link, &book.Pages, &createdAt, &updatedAt, &book.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	if book.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+		return nil, fmt.Errorf("invalid created_at for book %d: %w", book.Id, err)
+	}
+	if book.UpdatedAt, err = time.Parse(time.RFC3339Nano, updatedAt); err != nil {
+		return nil, fmt.Errorf("invalid updated_at for book %d: %w", book.Id, err)
+	}
+	return book, nil
+}
+
+func requireAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrBookNotFound
+	}
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	return t.Format(time.RFC3339Nano)
+}
@@ -0,0 +1,141 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package repositories
+
+import (
+	"errors"
+	"github.com/jkaninda/okapi-example/models"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRefreshTokenInvalid is returned for unknown, expired or revoked refresh tokens
+	ErrRefreshTokenInvalid = errors.New("invalid or expired refresh token")
+	// ErrRefreshTokenReused is returned when a refresh token is presented a second time,
+	// its whole family is revoked
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+)
+
+// RefreshTokenStore keeps track of issued refresh tokens.
+// Tokens are identified by the hash of their value, the raw value is never stored.
+type RefreshTokenStore interface {
+	// Save stores a newly issued refresh token
+	Save(token *models.RefreshToken) error
+	// Consume marks the token as used and returns it. Presenting a used token again
+	// revokes its family and returns ErrRefreshTokenReused.
+	Consume(hash string) (*models.RefreshToken, error)
+	// Revoke invalidates the token and every token descending from the same login
+	Revoke(hash string) error
+	// RevokeFamily invalidates every token descending from the same login
+	RevokeFamily(family string) error
+	// RevokeUser invalidates every token issued to the user
+	RevokeUser(username string) error
+}
+
+// sweepInterval is how often expired tokens are dropped from memory
+const sweepInterval = time.Minute
+
+// InMemoryRefreshTokenStore keeps refresh tokens in memory, it is safe for concurrent use
+type InMemoryRefreshTokenStore struct {
+	mu        sync.Mutex
+	tokens    map[string]*models.RefreshToken
+	lastSweep time.Time
+}
+
+// NewInMemoryRefreshTokenStore creates an empty refresh token store
+func NewInMemoryRefreshTokenStore() *InMemoryRefreshTokenStore {
+	return &InMemoryRefreshTokenStore{tokens: make(map[string]*models.RefreshToken), lastSweep: time.Now()}
+}
+
+func (s *InMemoryRefreshTokenStore) Save(token *models.RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+	t := *token
+	s.tokens[token.Hash] = &t
+	return nil
+}
+
+func (s *InMemoryRefreshTokenStore) Consume(hash string) (*models.RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[hash]
+	if !ok || token.Revoked || time.Now().After(token.ExpiresAt) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if token.Used {
+		s.revoke(func(t *models.RefreshToken) bool { return t.Family == token.Family })
+		return nil, ErrRefreshTokenReused
+	}
+	token.Used = true
+	t := *token
+	return &t, nil
+}
+
+func (s *InMemoryRefreshTokenStore) Revoke(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if token, ok := s.tokens[hash]; ok {
+		s.revoke(func(t *models.RefreshToken) bool { return t.Family == token.Family })
+	}
+	return nil
+}
+
+func (s *InMemoryRefreshTokenStore) RevokeFamily(family string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoke(func(t *models.RefreshToken) bool { return t.Family == family })
+	return nil
+}
+
+func (s *InMemoryRefreshTokenStore) RevokeUser(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoke(func(t *models.RefreshToken) bool { return t.Username == username })
+	return nil
+}
+
+func (s *InMemoryRefreshTokenStore) revoke(match func(t *models.RefreshToken) bool) {
+	for _, t := range s.tokens {
+		if match(t) {
+			t.Revoked = true
+		}
+	}
+}
+
+// sweep drops expired tokens, reuse of an expired token is reported as invalid anyway
+func (s *InMemoryRefreshTokenStore) sweep() {
+	now := time.Now()
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for hash, t := range s.tokens {
+		if now.After(t.ExpiresAt) {
+			delete(s.tokens, hash)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package repositories
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jkaninda/okapi-example/models"
+)
+
+func TestInMemoryRefreshTokenStoreConsume(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// tokens are saved in the family of their name, "other" belongs to another family
+		prepare func(s *InMemoryRefreshTokenStore)
+		hash    string
+		want    error
+		// revoked lists the tokens revoked once the token is consumed
+		revoked []string
+	}{
+		{name: "unused token", hash: "first"},
+		{name: "unknown token", hash: "unknown", want: ErrRefreshTokenInvalid},
+		{
+			name:    "expired token",
+			prepare: func(s *InMemoryRefreshTokenStore) { s.tokens["first"].ExpiresAt = time.Now().Add(-time.Second) },
+			hash:    "first",
+			want:    ErrRefreshTokenInvalid,
+		},
+		{
+			name:    "revoked token",
+			prepare: func(s *InMemoryRefreshTokenStore) { _ = s.Revoke("first") },
+			hash:    "first",
+			want:    ErrRefreshTokenInvalid,
+			revoked: []string{"first", "second"},
+		},
+		{
+			// The token was rotated, presenting it again means it was stolen: the whole family is revoked
+			name:    "reused token",
+			prepare: func(s *InMemoryRefreshTokenStore) { _, _ = s.Consume("first") },
+			hash:    "first",
+			want:    ErrRefreshTokenReused,
+			revoked: []string{"first", "second"},
+		},
+		{
+			name:    "reused token of another family",
+			prepare: func(s *InMemoryRefreshTokenStore) { _, _ = s.Consume("other") },
+			hash:    "other",
+			want:    ErrRefreshTokenReused,
+			revoked: []string{"other"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewInMemoryRefreshTokenStore()
+			expiresAt := time.Now().Add(time.Hour)
+			for hash, family := range map[string]string{"first": "login1", "second": "login1", "other": "login2"} {
+				if err := s.Save(&models.RefreshToken{Hash: hash, Family: family, Username: "alice", ExpiresAt: expiresAt}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.prepare != nil {
+				tc.prepare(s)
+			}
+			token, err := s.Consume(tc.hash)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("Consume(%s) error = %v, want %v", tc.hash, err, tc.want)
+			}
+			if err == nil && (token.Hash != tc.hash || !token.Used) {
+				t.Errorf("Consume(%s) = %+v", tc.hash, token)
+			}
+			for hash, token := range s.tokens {
+				if revoked := slices.Contains(tc.revoked, hash); token.Revoked != revoked {
+					t.Errorf("token %s revoked = %t, want %t", hash, token.Revoked, revoked)
+				}
+			}
+		})
+	}
+}
+
+func TestInMemoryRefreshTokenStoreRevokeUser(t *testing.T) {
+	s := NewInMemoryRefreshTokenStore()
+	expiresAt := time.Now().Add(time.Hour)
+	for hash, username := range map[string]string{"alice1": "alice", "alice2": "alice", "bob": "bob"} {
+		if err := s.Save(&models.RefreshToken{Hash: hash, Family: hash, Username: username, ExpiresAt: expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.RevokeUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	for hash, want := range map[string]error{"alice1": ErrRefreshTokenInvalid, "alice2": ErrRefreshTokenInvalid, "bob": nil} {
+		if _, err := s.Consume(hash); !errors.Is(err, want) {
+			t.Errorf("Consume(%s) error = %v, want %v", hash, err, want)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package repositories
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/okapi-example/models"
+	"github.com/jkaninda/okapi-example/utils"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUserNotFound is returned when a user does not exist
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUserExists is returned when creating a user whose username is already taken
+	ErrUserExists = errors.New("user already exists")
+	// ErrEmailExists is returned when storing a user whose email belongs to another user
+	ErrEmailExists = errors.New("email address is already used by another user")
+	// ErrInvalidCredentials is returned when a username and password do not match
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	// ErrUserDisabled is returned when authenticating a disabled user
+	ErrUserDisabled = errors.New("user is disabled")
+	// ErrOTPUsed is returned when consuming a TOTP time step or a recovery code that was already used
+	ErrOTPUsed = errors.New("one-time password already used")
+)
+
+// UserStore abstracts the storage of user accounts
+type UserStore interface {
+	// List returns all users ordered by username
+	List() ([]*models.User, error)
+	// Get returns the user with the given username, or ErrUserNotFound
+	Get(username string) (*models.User, error)
+	// Create stores a new user, or returns ErrUserExists, or ErrEmailExists
+	Create(user *models.User) error
+	// Update applies fn to a copy of the user and stores the result, or returns ErrUserNotFound, or ErrEmailExists.
+	// The store is locked while fn runs, so that concurrent changes of the user are not lost:
+	// fn must not call the store, and an error returned by fn leaves the user unchanged.
+	Update(username string, fn func(user *models.User) error) (*models.User, error)
+	// Count returns the number of stored users
+	Count() (int, error)
+	// ConsumeOTPStep records the TOTP time step as the last one used by the user,
+	// or returns ErrOTPUsed when a code of the same or a later step was already accepted
+	ConsumeOTPStep(username string, step int64) error
+	// ConsumeRecoveryCode removes the recovery code hash from the user and returns the number of codes left,
+	// or returns ErrOTPUsed when the user does not have it
+	ConsumeRecoveryCode(username, hash string) (int, error)
+}
+
+// Authenticate returns the user matching the username and password, or ErrInvalidCredentials.
+// Disabled users are rejected with ErrUserDisabled once their password is verified.
+func Authenticate(store UserStore, username, password string) (*models.User, error) {
+	user, err := store.Get(username)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			// Spend the same time as a wrong password
+			utils.VerifyPassword("", password)
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+	if !utils.VerifyPassword(user.PasswordHash, password) {
+		return nil, ErrInvalidCredentials
+	}
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+	return user, nil
+}
+
+// InMemoryUserStore keeps users in memory, it is safe for concurrent use
+type InMemoryUserStore struct {
+	mu    sync.RWMutex
+	users map[string]*models.User
+}
+
+// NewInMemoryUserStore creates an in-memory store holding the given users
+func NewInMemoryUserStore(users ...*models.User) *InMemoryUserStore {
+	s := &InMemoryUserStore{users: make(map[string]*models.User, len(users))}
+	for _, user := range users {
+		_ = s.Create(user)
+	}
+	return s
+}
+
+func (s *InMemoryUserStore) List() ([]*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]*models.User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, copyUser(user))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+func (s *InMemoryUserStore) Get(username string) (*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return copyUser(user), nil
+}
+
+func (s *InMemoryUserStore) Create(user *models.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.users[user.Username]; exists {
+		return ErrUserExists
+	}
+	if s.emailTaken(user) {
+		return ErrEmailExists
+	}
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now()
+	}
+	if user.UpdatedAt.IsZero() {
+		user.UpdatedAt = user.CreatedAt
+	}
+	s.users[user.Username] = copyUser(user)
+	return nil
+}
+
+func (s *InMemoryUserStore) Update(username string, fn func(user *models.User) error) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	user := copyUser(existing)
+	if err := fn(user); err != nil {
+		return nil, err
+	}
+	user.Username = existing.Username
+	user.CreatedAt = existing.CreatedAt
+	if s.emailTaken(user) {
+		return nil, ErrEmailExists
+	}
+	user.UpdatedAt = time.Now()
+	s.users[username] = copyUser(user)
+	return user, nil
+}
+
+func (s *InMemoryUserStore) Count() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.users), nil
+}
+
+func (s *InMemoryUserStore) ConsumeOTPStep(username string, step int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if step <= user.TOTPLastStep {
+		return ErrOTPUsed
+	}
+	user.TOTPLastStep = step
+	user.UpdatedAt = time.Now()
+	return nil
+}
+
+func (s *InMemoryUserStore) ConsumeRecoveryCode(username, hash string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return 0, ErrUserNotFound
+	}
+	i := slices.Index(user.RecoveryCodes, hash)
+	if i < 0 {
+		return 0, ErrOTPUsed
+	}
+	user.RecoveryCodes = slices.Delete(user.RecoveryCodes, i, i+1)
+	user.UpdatedAt = time.Now()
+	return len(user.RecoveryCodes), nil
+}
+
+// restore puts back the previous version of a user after a failed change, nil removes the user
+func (s *InMemoryUserStore) restore(username string, previous *models.User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if previous == nil {
+		delete(s.users, username)
+		return
+	}
+	s.users[username] = previous
+}
+
+// emailTaken reports whether another user has the email of the user, emails are compared case-insensitively
+func (s *InMemoryUserStore) emailTaken(user *models.User) bool {
+	if user.Email == "" {
+		return false
+	}
+	for username, other := range s.users {
+		if username != user.Username && strings.EqualFold(other.Email, user.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+func copyUser(user *models.User) *models.User {
+	u := *user
+	u.Permissions = slices.Clone(user.Permissions)
+	u.RecoveryCodes = slices.Clone(user.RecoveryCodes)
+	return &u
+}
+
+// FileUserStore keeps users in memory and writes every change to a JSON file
+type FileUserStore struct {
+	*InMemoryUserStore
+	path string
+	// changeMu serializes changes, so that a failed change is undone before the next one is written
+	changeMu sync.Mutex
+}
+
+// NewFileUserStore loads the users stored in path, a missing file starts an empty store
+func NewFileUserStore(path string) (*FileUserStore, error) {
+	var users []*models.User
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read users data: %w", err)
+	default:
+		if err = json.Unmarshal(data, &users); err != nil {
+			return nil, fmt.Errorf("failed to parse users data: %w", err)
+		}
+		logger.Info("Users loaded", "file", path, "count", len(users))
+	}
+	return &FileUserStore{InMemoryUserStore: NewInMemoryUserStore(users...), path: path}, nil
+}
+
+func (s *FileUserStore) Create(user *models.User) error {
+	return s.change(user.Username, func() error {
+		return s.InMemoryUserStore.Create(user)
+	})
+}
+
+func (s *FileUserStore) Update(username string, fn func(user *models.User) error) (*models.User, error) {
+	var user *models.User
+	err := s.change(username, func() (err error) {
+		user, err = s.InMemoryUserStore.Update(username, fn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *FileUserStore) ConsumeOTPStep(username string, step int64) error {
+	return s.change(username, func() error {
+		return s.InMemoryUserStore.ConsumeOTPStep(username, step)
+	})
+}
+
+func (s *FileUserStore) ConsumeRecoveryCode(username, hash string) (int, error) {
+	var remaining int
+	err := s.change(username, func() (err error) {
+		remaining, err = s.InMemoryUserStore.ConsumeRecoveryCode(username, hash)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return remaining, nil
+}
+
+// change applies a change of the user in memory and writes the users,
+// the user is restored when the write fails so that memory and disk agree
+func (s *FileUserStore) change(username string, apply func() error) error {
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+	previous, err := s.Get(username)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	if err = apply(); err != nil {
+		return err
+	}
+	if err = s.write(); err != nil {
+		s.restore(username, previous)
+		return err
+	}
+	return nil
+}
+
+func (s *FileUserStore) write() error {
+	users, err := s.List()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode users data: %w", err)
+	}
+	return writeFileAtomic(s.path, data, true)
+}
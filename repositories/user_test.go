@@ -0,0 +1,184 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package repositories
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/jkaninda/okapi-example/models"
+)
+
+// TestInMemoryUserStoreUpdateKeepsConsumedCodes changes the profile while recovery codes and TOTP steps
+// are consumed, run it with -race. No change may bring back a consumed code or step.
+func TestInMemoryUserStoreUpdateKeepsConsumedCodes(t *testing.T) {
+	const codeCount = 50
+	user := &models.User{Username: "alice", Email: "alice@example.com", TOTPEnabled: true}
+	for i := 0; i < codeCount; i++ {
+		user.RecoveryCodes = append(user.RecoveryCodes, fmt.Sprintf("hash%d", i))
+	}
+	store := NewInMemoryUserStore(user)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < codeCount; i++ {
+			if _, err := store.ConsumeRecoveryCode("alice", fmt.Sprintf("hash%d", i)); err != nil {
+				t.Errorf("ConsumeRecoveryCode(hash%d) error = %v", i, err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for step := int64(1); step <= codeCount; step++ {
+			if err := store.ConsumeOTPStep("alice", step); err != nil {
+				t.Errorf("ConsumeOTPStep(%d) error = %v", step, err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < codeCount; i++ {
+			_, err := store.Update("alice", func(user *models.User) error {
+				user.Name = fmt.Sprintf("Alice %d", i)
+				return nil
+			})
+			if err != nil {
+				t.Errorf("Update() error = %v", err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	got, err := store.Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.RecoveryCodes) != 0 {
+		t.Errorf("recovery codes %v are back after concurrent updates", got.RecoveryCodes)
+	}
+	if got.TOTPLastStep != codeCount {
+		t.Errorf("TOTPLastStep = %d, want %d", got.TOTPLastStep, codeCount)
+	}
+	if got.Name != fmt.Sprintf("Alice %d", codeCount-1) {
+		t.Errorf("Name = %q, want the last update", got.Name)
+	}
+}
+
+func TestInMemoryUserStoreUpdate(t *testing.T) {
+	store := NewInMemoryUserStore(
+		&models.User{Username: "alice", Email: "alice@example.com"},
+		&models.User{Username: "bob", Email: "bob@example.com"},
+	)
+	errAbort := errors.New("abort")
+	if _, err := store.Update("alice", func(user *models.User) error {
+		user.Name = "changed"
+		return errAbort
+	}); !errors.Is(err, errAbort) {
+		t.Errorf("Update() error = %v, want the error of fn", err)
+	}
+	if _, err := store.Update("alice", func(user *models.User) error {
+		user.Email = "BOB@example.com"
+		return nil
+	}); !errors.Is(err, ErrEmailExists) {
+		t.Errorf("Update(email of bob) error = %v, want ErrEmailExists", err)
+	}
+	if _, err := store.Update("carol", func(*models.User) error { return nil }); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Update(unknown user) error = %v, want ErrUserNotFound", err)
+	}
+	updated, err := store.Update("alice", func(user *models.User) error {
+		user.Username = "renamed"
+		user.Name = "Alice"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fn can not rename the user
+	if updated.Username != "alice" {
+		t.Errorf("Username = %q, want alice", updated.Username)
+	}
+	got, err := store.Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "Alice" || got.Email != "alice@example.com" {
+		t.Errorf("stored user = %+v, want only the last update applied", got)
+	}
+}
+
+func TestFileUserStoreRollback(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFileUserStore(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{Username: "alice", Email: "alice@example.com", TOTPEnabled: true, RecoveryCodes: []string{"hash"}}
+	if err = store.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	// Writes fail once the directory is replaced by a file
+	if err = os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(dir, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.Create(&models.User{Username: "bob", Email: "bob@example.com"}); err == nil {
+		t.Error("Create() succeeded without writing the file")
+	}
+	if _, err = store.Update("alice", func(user *models.User) error {
+		user.Name = "Alice"
+		return nil
+	}); err == nil {
+		t.Error("Update() succeeded without writing the file")
+	}
+	if err = store.ConsumeOTPStep("alice", 1); err == nil {
+		t.Error("ConsumeOTPStep() succeeded without writing the file")
+	}
+	if _, err = store.ConsumeRecoveryCode("alice", "hash"); err == nil {
+		t.Error("ConsumeRecoveryCode() succeeded without writing the file")
+	}
+
+	if _, err = store.Get("bob"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Get(bob) error = %v, want ErrUserNotFound after the failed create", err)
+	}
+	got, err := store.Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "" || got.TOTPLastStep != 0 || len(got.RecoveryCodes) != 1 {
+		t.Errorf("alice = %+v, want the failed changes undone", got)
+	}
+}
@@ -25,8 +25,18 @@
 package routes
 
 import (
+	"context"
+	"fmt"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/okapi-example/config"
 	"github.com/jkaninda/okapi-example/controllers"
 	"github.com/jkaninda/okapi-example/models"
+	"github.com/jkaninda/okapi-example/oidc"
+	"github.com/jkaninda/okapi-example/rbac"
+	"github.com/jkaninda/okapi-example/repositories"
+	"github.com/jkaninda/okapi-example/search"
+	"github.com/jkaninda/okapi-example/utils"
+	"io"
 	"net/http"
 
 	"github.com/jkaninda/okapi"
@@ -34,25 +44,42 @@ import (
 )
 
 var (
-	bookController     = &controllers.BookController{}
 	homeController     = &controllers.HomeController{}
-	authController     = &controllers.AuthController{}
 	bearerAuthSecurity = []map[string][]string{
 		{
 			"bearerAuth": {},
 		},
 	}
+	// bearerOrAPIKeySecurity documents routes accepting either a JWT or an API key
+	bearerOrAPIKeySecurity = []map[string][]string{
+		{
+			"bearerAuth": {},
+		},
+		{
+			"apiKeyAuth": {},
+		},
+	}
 )
 
 // You can also use this example
 
 type Route struct {
-	app *okapi.Okapi
+	app              *okapi.Okapi
+	bookRepository   repositories.BookRepository
+	bookController   *controllers.BookController
+	authController   *controllers.AuthController
+	apiKeyController *controllers.APIKeyController
+	denylist         repositories.TokenDenylist
+	loginGuard       *middlewares.LoginGuard
+	// rateLimits are the rate limiting middlewares by group of routes, disabled groups have none
+	rateLimits map[string]okapi.Middleware
+	// oidcEnabled registers the OpenID Connect login routes
+	oidcEnabled bool
 }
 
 // NewRoute creates a new Route instance with the provided Okapi app
-// NewRoute creates a new Route instance with the Okapi application
-func NewRoute(app *okapi.Okapi) *Route {
+// NewRoute creates a new Route instance with the Okapi application and its configuration
+func NewRoute(app *okapi.Okapi, cfg *config.Config) *Route {
 	// Update OpenAPI documentation with the application title and version
 	app.WithOpenAPIDocs(okapi.OpenAPI{
 		Title:   "Okapi Web Framework Example",
@@ -67,13 +94,211 @@ func NewRoute(app *okapi.Okapi) *Route {
 				Scheme:       "bearer",
 				BearerFormat: "JWT",
 			},
+			{
+				// okapi has no field for the location of API keys, the header is named in the description
+				Name:        "apiKeyAuth",
+				Type:        "apiKey",
+				Description: "API key sent in the " + middlewares.APIKeyHeader + " header, accepted on the /core and /admin routes",
+			},
 		},
 	})
+	// Tag every request with an ID, first so that the other middlewares log it
+	app.Use(middlewares.RequestID)
+	err := middlewares.Configure(cfg.JWT)
+	if err != nil {
+		logger.Fatal("Error loading JWT signing key", "error", err)
+	}
+	if err = middlewares.ConfigureAdmin(cfg.Admin, cfg.Proxy); err != nil {
+		logger.Fatal("Error configuring admin routes", "error", err)
+	}
+	policy, err := rbac.LoadPolicy(cfg.RBAC.PolicyFile)
+	if err != nil {
+		logger.Fatal("Error loading RBAC policy", "error", err)
+	}
+	middlewares.SetPolicy(policy)
+	bookRepository, err := newBookRepository(cfg.Books)
+	if err != nil {
+		logger.Fatal("Error initializing book storage", "error", err)
+	}
+	// Keep the search index in sync with the book storage
+	bookIndex := search.NewIndex()
+	indexedRepository, err := repositories.NewIndexedBookRepository(bookRepository, bookIndex)
+	if err != nil {
+		logger.Fatal("Error indexing books", "error", err)
+	}
+	userStore, err := newUserStore(cfg.Users)
+	if err != nil {
+		logger.Fatal("Error initializing user storage", "error", err)
+	}
+	denylist := repositories.NewInMemoryTokenDenylist()
+	apiKeys, err := newAPIKeyStore(cfg.APIKeys)
+	if err != nil {
+		logger.Fatal("Error initializing API key storage", "error", err)
+	}
+	middlewares.ConfigureAPIKeys(apiKeys, cfg.Proxy)
+	limits, err := cfg.RateLimit.Groups()
+	if err != nil {
+		logger.Fatal("Error configuring rate limits", "error", err)
+	}
+	// Quotas are kept per instance, a shared RateLimitStore enforces them across instances
+	rateLimitStore := repositories.NewInMemoryRateLimitStore()
+	rateLimits := make(map[string]okapi.Middleware, len(limits))
+	for group, limit := range limits {
+		limiter := &middlewares.RateLimiter{Scope: group, Limit: limit, Store: rateLimitStore, Proxy: cfg.Proxy}
+		rateLimits[group] = limiter.Middleware
+	}
+	loginGuard := middlewares.NewLoginGuard(cfg.Login, cfg.Proxy)
+	authController := controllers.NewAuthController(cfg, userStore, repositories.NewInMemoryRefreshTokenStore(), denylist, loginGuard)
+	if cfg.OIDC.Enabled() {
+		provider, err := oidc.Discover(context.Background(), cfg.OIDC)
+		if err != nil {
+			logger.Fatal("Error configuring OIDC provider", "error", err)
+		}
+		for _, role := range provider.Roles() {
+			if !policy.HasRole(role) {
+				logger.Fatal("Error configuring OIDC provider", "error", fmt.Errorf("role %q is not defined in the RBAC policy", role))
+			}
+		}
+		authController.EnableOIDC(provider)
+	}
 	return &Route{
-		app: app,
+		app:              app,
+		bookRepository:   indexedRepository,
+		bookController:   controllers.NewBookController(indexedRepository, bookIndex),
+		authController:   authController,
+		apiKeyController: controllers.NewAPIKeyController(apiKeys),
+		denylist:         denylist,
+		loginGuard:       loginGuard,
+		rateLimits:       rateLimits,
+		oidcEnabled:      cfg.OIDC.Enabled(),
+	}
+}
+
+// ownershipNote documents the check of middlewares.RequireBookOwner
+const ownershipNote = "Books created by other users require the `" + rbac.BooksAny + "` permission"
+
+// etagHeader documents the ETag header of the responses carrying a book
+var etagHeader = okapi.DocResponseHeader("ETag", "string", "Version of the book, send it in If-Match to change this version only")
+
+// ifMatchHeader documents the precondition of the routes changing a book
+var ifMatchHeader = okapi.DocHeader("If-Match", "string",
+	"ETag of the book, the request fails with 412 when the book was changed since. "+
+		"A concurrent change of the book fails the request with 409 when the header is missing", false)
+
+// requires documents the permission a route requires in its description
+func requires(description, permission string) string {
+	return fmt.Sprintf("%s.\n\nRequires the `%s` permission.", description, permission)
+}
+
+// rateLimit returns the rate limiting middleware of a group of routes, none when its limit is disabled
+func (r *Route) rateLimit(group string) []okapi.Middleware {
+	if limit, ok := r.rateLimits[group]; ok {
+		return []okapi.Middleware{limit}
+	}
+	return nil
+}
+
+// Close releases the resources held by the routes, such as the book storage
+func (r *Route) Close() error {
+	if closer, ok := r.bookRepository.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// newBookRepository creates the configured book storage
+// and seeds it with the demo dataset on first start
+func newBookRepository(cfg config.BooksConfig) (repositories.BookRepository, error) {
+	switch cfg.Storage {
+	case "memory":
+		repo := repositories.NewInMemoryBookRepository()
+		if err := repositories.SeedFromFile(repo, cfg.SeedFile); err != nil {
+			logger.Error("Error seeding books", "error", err)
+		}
+		return repo, nil
+	case "sqlite":
+		repo, err := repositories.NewSQLiteBookRepository(cfg.SQLitePath)
+		if err != nil {
+			return nil, err
+		}
+		// Seeded until books are stored, a seeding interrupted by a crash is retried on the next start
+		count, err := repo.Count()
+		if err != nil {
+			_ = repo.Close()
+			return nil, fmt.Errorf("failed to count books: %w", err)
+		}
+		if count == 0 {
+			if err = repositories.SeedFromFile(repo, cfg.SeedFile); err != nil {
+				logger.Error("Error seeding books", "error", err)
+			}
+		}
+		return repo, nil
+	case "file":
+		return repositories.NewFileBookRepository(cfg.BookFile(), repositories.FileOptions{
+			Debounce: cfg.FileDebounce,
+			Fsync:    cfg.FileFsync,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported book storage %q", cfg.Storage)
+	}
+}
+
+// newAPIKeyStore creates the configured API key storage
+func newAPIKeyStore(cfg config.APIKeysConfig) (repositories.APIKeyStore, error) {
+	switch cfg.Storage {
+	case "memory":
+		return repositories.NewInMemoryAPIKeyStore(), nil
+	case "file":
+		fileStore, err := repositories.NewFileAPIKeyStore(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		return fileStore, nil
+	default:
+		return nil, fmt.Errorf("unsupported API key storage %q", cfg.Storage)
 	}
 }
 
+// newUserStore creates the configured user storage
+// and creates the demo accounts when it is empty
+func newUserStore(cfg config.UsersConfig) (repositories.UserStore, error) {
+	var store repositories.UserStore
+	switch cfg.Storage {
+	case "memory":
+		store = repositories.NewInMemoryUserStore()
+	case "file":
+		fileStore, err := repositories.NewFileUserStore(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		store = fileStore
+	default:
+		return nil, fmt.Errorf("unsupported user storage %q", cfg.Storage)
+	}
+	count, err := store.Count()
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return store, nil
+	}
+	for _, user := range []models.User{
+		{Username: "admin", Name: "ADMIN", Email: "admin@example.com", EmailVerified: true, Role: "admin"},
+		{Username: "user", Name: "USER", Email: "user@example.com", EmailVerified: true, Role: "user"},
+	} {
+		user.Permissions = middlewares.Policy().Permissions(user.Role)
+		user.PasswordHash, err = utils.HashPassword("password")
+		if err != nil {
+			return nil, err
+		}
+		if err = store.Create(&user); err != nil {
+			return nil, err
+		}
+	}
+	logger.Warn("Created demo users admin and user with the default password, change it before going to production")
+	return store, nil
+}
+
 // ****************** Route Definitions ******************
 
 // Home returns the route definition for the HomeController
@@ -104,37 +329,72 @@ func (r *Route) WhoAmI() okapi.RouteDefinition {
 	}
 }
 
+// JWKS returns the route definition publishing the public keys JWT tokens are signed with
+func (r *Route) JWKS() okapi.RouteDefinition {
+	return okapi.RouteDefinition{
+		Path:    "/.well-known/jwks.json",
+		Method:  http.MethodGet,
+		Handler: r.authController.JWKS,
+		Group:   &okapi.Group{Prefix: "/", Tags: []string{"AuthController"}},
+		Options: []okapi.RouteOption{
+			okapi.DocSummary("JSON Web Key Set"),
+			okapi.DocDescription("Public keys to verify JWT tokens with, selected by the kid header of the token. Empty when tokens are signed with an HMAC secret"),
+			okapi.DocResponse(models.JWKS{}),
+		},
+	}
+}
+
 // ************* Book Routes *************
 
+// bookListDocs documents the pagination, sorting and filtering parameters of a book listing
+func bookListDocs(description string) []okapi.RouteOption {
+	return []okapi.RouteOption{
+		okapi.DocSummary("Get Books"),
+		okapi.DocDescription(description),
+		okapi.DocQueryParam("page", "int", "Page number, default 1", false),
+		okapi.DocQueryParam("pageSize", "int", "Number of books per page, default 20, max 100", false),
+		okapi.DocQueryParam("sort", "string", "Comma-separated sort fields, prefixed with - for descending order, e.g. price,-year. "+
+			"Supported fields: id, title, price, year, author, country, language, pages, createdAt, updatedAt", false),
+		okapi.DocQueryParam("author", "string", "Filter by author, partial match", false),
+		okapi.DocQueryParam("country", "string", "Filter by country of origin", false),
+		okapi.DocQueryParam("language", "string", "Filter by language", false),
+		okapi.DocQueryParam("minYear", "int", "Minimum year of publication", false),
+		okapi.DocQueryParam("maxYear", "int", "Maximum year of publication", false),
+		okapi.DocQueryParam("minPrice", "int", "Minimum price", false),
+		okapi.DocQueryParam("maxPrice", "int", "Maximum price", false),
+		okapi.DocResponseHeader("Link", "string", "Links to the first, previous, next and last pages"),
+		okapi.DocResponse(models.BookPage{}),
+		okapi.DocResponse(http.StatusBadRequest, models.ErrorResponse{}),
+	}
+}
+
 // APIBookRoutes returns the route definitions for the BookController
 func (r *Route) APIBookRoutes() []okapi.RouteDefinition {
 	apiGroup := &okapi.Group{Prefix: "/api", Tags: []string{"BookController"}}
+	// Shares the quota of the /books routes
+	apiGroup.Use(r.rateLimit("books")...)
 	apiGroup.Use(middlewares.CustomMiddleware)
 	apiGroup.Deprecated()
 	return []okapi.RouteDefinition{
 		{
 			Method:      http.MethodGet,
 			Path:        "/books",
-			Handler:     bookController.GetBooks,
+			Handler:     r.bookController.GetBooks,
 			Group:       apiGroup,
 			Middlewares: []okapi.Middleware{},
-			Options: []okapi.RouteOption{
-				okapi.DocSummary("Get Books"),
-				okapi.DocDescription("Retrieve a list of books"),
-				okapi.DocResponse([]models.Book{}),
-				okapi.DocResponse(http.StatusBadRequest, models.ErrorResponse{}),
-			},
+			Options:     bookListDocs("Retrieve a paginated list of books"),
 		},
 		{
 			Method:  http.MethodGet,
 			Path:    "/books/:id",
-			Handler: bookController.GetBook,
+			Handler: r.bookController.GetBook,
 			Group:   apiGroup,
 			Options: []okapi.RouteOption{
 				okapi.DocSummary("Get Book by ID"),
 				okapi.DocDescription("Retrieve a book by its ID"),
 				okapi.DocPathParam("id", "int", "The ID of the book"),
 				okapi.DocResponse(models.Book{}),
+				etagHeader,
 				okapi.DocResponse(http.StatusBadRequest, models.ErrorResponse{}),
 				okapi.DocResponse(http.StatusNotFound, models.ErrorResponse{}),
 			},
@@ -142,29 +402,42 @@ func (r *Route) APIBookRoutes() []okapi.RouteDefinition {
 	}
 }
 func (r *Route) BookRoutes() []okapi.RouteDefinition {
+	bookMiddlewares := append(r.rateLimit("books"), middlewares.CustomMiddleware)
 	return []okapi.RouteDefinition{
 		{
 			Method:      http.MethodGet,
 			Path:        "/books",
-			Handler:     bookController.GetBooks,
-			Middlewares: []okapi.Middleware{middlewares.CustomMiddleware},
+			Handler:     r.bookController.GetBooks,
+			Middlewares: bookMiddlewares,
+			Options:     bookListDocs("Retrieve a paginated list of books"),
+		},
+		{
+			// Registered before /books/:id so that "search" is not taken for an ID
+			Method:      http.MethodGet,
+			Path:        "/books/search",
+			Handler:     r.bookController.SearchBooks,
+			Middlewares: bookMiddlewares,
 			Options: []okapi.RouteOption{
-				okapi.DocSummary("Get Books"),
-				okapi.DocDescription("Retrieve a list of books"),
-				okapi.DocResponse([]models.Book{}),
+				okapi.DocSummary("Search Books"),
+				okapi.DocDescription("Full-text search over book titles and authors. Matching is case-insensitive and ignores accents, " +
+					"results are ranked by relevance and matched terms are wrapped in <mark> tags of the HTML escaped highlights"),
+				okapi.DocQueryParam("q", "string", "Search terms", true),
+				okapi.DocQueryParam("limit", "int", "Maximum number of results, default 20, max 100", false),
+				okapi.DocResponse(models.SearchResponse{}),
 				okapi.DocResponse(http.StatusBadRequest, models.ErrorResponse{}),
 			},
 		},
 		{
 			Method:      http.MethodGet,
 			Path:        "/books/:id",
-			Handler:     bookController.GetBook,
-			Middlewares: []okapi.Middleware{middlewares.CustomMiddleware},
+			Handler:     r.bookController.GetBook,
+			Middlewares: bookMiddlewares,
 			Options: []okapi.RouteOption{
 				okapi.DocSummary("Get Book by ID"),
 				okapi.DocDescription("Retrieve a book by its ID"),
 				okapi.DocPathParam("id", "int", "The ID of the book"),
 				okapi.DocResponse(models.Book{}),
+				etagHeader,
 				okapi.DocResponse(http.StatusBadRequest, models.ErrorResponse{}),
 				okapi.DocResponse(http.StatusNotFound, models.ErrorResponse{}),
 			},
@@ -174,38 +447,124 @@ func (r *Route) BookRoutes() []okapi.RouteDefinition {
 
 // *************** Auth Routes ****************
 
-func (r *Route) AuthRoute() okapi.RouteDefinition {
+func (r *Route) AuthRoutes() []okapi.RouteDefinition {
 	apiGroup := &okapi.Group{Prefix: "/auth", Tags: []string{"AuthController"}}
+	apiGroup.Use(r.rateLimit("auth")...)
 	apiGroup.Use(middlewares.CustomMiddleware)
-	return okapi.RouteDefinition{
-
-		Method:  http.MethodPost,
-		Path:    "/login",
-		Handler: authController.Login,
-		Group:   apiGroup,
-		Options: []okapi.RouteOption{
-			okapi.DocSummary("Login"),
-			okapi.DocDescription("User login to get a JWT token"),
-			okapi.DocRequestBody(models.AuthRequest{}),
-			okapi.DocResponse(models.AuthResponse{}),
-			okapi.DocResponse(http.StatusUnauthorized, models.AuthResponse{}),
+	routes := []okapi.RouteDefinition{
+		{
+			Method:      http.MethodPost,
+			Path:        "/login",
+			Handler:     r.authController.Login,
+			Group:       apiGroup,
+			Middlewares: []okapi.Middleware{r.loginGuard.Middleware},
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Login"),
+				okapi.DocDescription("User login to get a short-lived JWT token and a refresh token. " +
+					"Users with two-factor authentication enabled must send a TOTP or recovery code in `otp`, `mfaRequired` is set when it is missing or wrong. " +
+					"Repeated failures for a username or from an address are delayed then locked out, answered with 429 and a `Retry-After` header"),
+				okapi.DocRequestBody(models.AuthRequest{}),
+				okapi.DocResponse(models.AuthResponse{}),
+				okapi.DocResponse(http.StatusUnauthorized, models.AuthResponse{}),
+				okapi.DocResponse(http.StatusTooManyRequests, models.AuthResponse{}),
+			},
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/refresh",
+			Handler: r.authController.Refresh,
+			Group:   apiGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Refresh token"),
+				okapi.DocDescription("Exchange a refresh token for a new JWT token and a new refresh token. " +
+					"Refresh tokens are single-use, presenting a used one revokes every token issued from the same login"),
+				okapi.DocRequestBody(models.RefreshRequest{}),
+				okapi.DocResponse(models.AuthResponse{}),
+				okapi.DocResponse(http.StatusUnauthorized, models.AuthResponse{}),
+			},
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/logout",
+			Handler:     r.authController.Logout,
+			Group:       apiGroup,
+			Middlewares: []okapi.Middleware{middlewares.Revocable(middlewares.JWTAuth, r.denylist)},
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Logout"),
+				okapi.DocDescription("Revoke the JWT token used for the request and, when given, the refresh token"),
+				okapi.DocRequestBody(models.LogoutRequest{}),
+				okapi.DocResponse(models.AuthResponse{}),
+				okapi.DocResponse(http.StatusUnauthorized, models.ErrorResponse{}),
+			},
+			Security: bearerAuthSecurity,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/register",
+			Handler: r.authController.Register,
+			Group:   apiGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Register"),
+				okapi.DocDescription("Create a new user account with the user role. " +
+					"Its email is unverified, its tokens are rejected by the /core and /admin routes until an admin verifies it"),
+				okapi.DocRequestBody(models.RegisterRequest{}),
+				okapi.DocResponse(http.StatusCreated, models.UserInfo{}),
+				okapi.DocResponse(http.StatusBadRequest, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusConflict, models.ErrorResponse{}),
+			},
 		},
 	}
+	if !r.oidcEnabled {
+		return routes
+	}
+	return append(routes,
+		okapi.RouteDefinition{
+			Method:  http.MethodGet,
+			Path:    "/oidc/login",
+			Handler: r.authController.OIDCLogin,
+			Group:   apiGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("OIDC login"),
+				okapi.DocDescription("Redirect to the OpenID Connect provider to log in with the authorization code flow and PKCE"),
+				okapi.DocResponseHeader("Location", "string", "Authorization endpoint of the provider"),
+				okapi.DocResponseHeader("Set-Cookie", "string", "The `oidc_state` cookie binding the login to the browser"),
+				okapi.DocResponse(http.StatusServiceUnavailable, models.ErrorResponse{}),
+			},
+		},
+		okapi.RouteDefinition{
+			Method:  http.MethodGet,
+			Path:    "/oidc/callback",
+			Handler: r.authController.OIDCCallback,
+			Group:   apiGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("OIDC callback"),
+				okapi.DocDescription("Complete a login at the OpenID Connect provider, the provider redirects here with `state` and `code`. " +
+					"The state must match the `oidc_state` cookie set by /auth/oidc/login. " +
+					"Users are created on their first login, their role is mapped from the claims of the ID token on every login"),
+				okapi.DocResponse(models.AuthResponse{}),
+				okapi.DocResponse(http.StatusBadRequest, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusUnauthorized, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
+			},
+		},
+	)
 }
 
 // ************** Authenticated Routes **************
 
 func (r *Route) CommonRoutes() []okapi.RouteDefinition {
 	coreGroup := &okapi.Group{Prefix: "/core", Tags: []string{"SecurityController"}}
-	// Apply JWT authentication middleware to the admin group
-	coreGroup.Use(middlewares.JWTAuth.Middleware)
+	// Apply API key or JWT authentication middleware to the core group
+	coreGroup.Use(middlewares.APIKeyAuth.Or(middlewares.Revocable(middlewares.JWTAuth, r.denylist)))
+	// Limited after authentication, so that each API key and user has their own quota
+	coreGroup.Use(r.rateLimit("core")...)
 	coreGroup.Use(middlewares.CustomMiddleware)
-	coreGroup.WithSecurity(bearerAuthSecurity) //Enable Bearer token for OpenAPI documentation
+	coreGroup.WithSecurity(bearerOrAPIKeySecurity) //Enable Bearer token and API key for OpenAPI documentation
 	return []okapi.RouteDefinition{
 		{
 			Method:  http.MethodPost,
 			Path:    "/whoami",
-			Handler: authController.WhoAmI,
+			Handler: r.authController.WhoAmI,
 			Group:   coreGroup,
 			Options: []okapi.RouteOption{
 				okapi.DocSummary("Whoami"),
@@ -213,6 +572,105 @@ func (r *Route) CommonRoutes() []okapi.RouteDefinition {
 				okapi.DocResponse(models.UserInfo{}),
 			},
 		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/me",
+			Handler: r.authController.Me,
+			Group:   coreGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Get my account"),
+				okapi.DocDescription("Get the account of the current user"),
+				okapi.DocResponse(models.UserInfo{}),
+				okapi.DocResponse(http.StatusNotFound, models.ErrorResponse{}),
+			},
+		},
+		{
+			Method:  http.MethodPut,
+			Path:    "/me",
+			Handler: r.authController.UpdateMe,
+			Group:   coreGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Update my account"),
+				okapi.DocDescription("Update the name and email of the current user"),
+				okapi.DocRequestBody(models.UpdateProfileRequest{}),
+				okapi.DocResponse(models.UserInfo{}),
+				okapi.DocResponse(http.StatusBadRequest, models.ErrorResponse{}),
+			},
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/me/password",
+			Handler: r.authController.ChangePassword,
+			Group:   coreGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Change my password"),
+				okapi.DocDescription("Change the password of the current user, the current password is required"),
+				okapi.DocRequestBody(models.ChangePasswordRequest{}),
+				okapi.DocResponse(models.UserInfo{}),
+				okapi.DocResponse(http.StatusBadRequest, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
+			},
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/me/mfa/totp",
+			Handler: r.authController.EnrollTOTP,
+			Group:   coreGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Enroll TOTP"),
+				okapi.DocDescription("Generate a TOTP secret for the current user. Add it to an authenticator app by scanning the QR code of the returned URI, " +
+					"then confirm with the first code to enable two-factor authentication"),
+				okapi.DocResponse(models.TOTPEnrollment{}),
+				okapi.DocResponse(http.StatusConflict, models.ErrorResponse{}),
+			},
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/me/mfa/totp/confirm",
+			Handler: r.authController.ConfirmTOTP,
+			Group:   coreGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Confirm TOTP"),
+				okapi.DocDescription("Enable two-factor authentication with a code of the authenticator app. " +
+					"Returns recovery codes, each one can replace a code once, they are not shown again"),
+				okapi.DocRequestBody(models.TOTPCodeRequest{}),
+				okapi.DocResponse(models.RecoveryCodes{}),
+				okapi.DocResponse(http.StatusBadRequest, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusConflict, models.ErrorResponse{}),
+			},
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/me/mfa/recovery-codes",
+			Handler: r.authController.RegenerateRecoveryCodes,
+			Group:   coreGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Regenerate recovery codes"),
+				okapi.DocDescription("Replace the recovery codes of the current user, a TOTP or recovery code is required. " +
+					"Repeated invalid codes are delayed then locked out like failed logins, answered with 429 and a `Retry-After` header"),
+				okapi.DocRequestBody(models.TOTPCodeRequest{}),
+				okapi.DocResponse(models.RecoveryCodes{}),
+				okapi.DocResponse(http.StatusBadRequest, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusTooManyRequests, models.ErrorResponse{}),
+			},
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/me/mfa/totp/disable",
+			Handler: r.authController.DisableTOTP,
+			Group:   coreGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Disable TOTP"),
+				okapi.DocDescription("Turn off two-factor authentication of the current user, a TOTP or recovery code is required. " +
+					"Repeated invalid codes are delayed then locked out like failed logins, answered with 429 and a `Retry-After` header"),
+				okapi.DocRequestBody(models.TOTPCodeRequest{}),
+				okapi.DocResponse(models.UserInfo{}),
+				okapi.DocResponse(http.StatusBadRequest, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusTooManyRequests, models.ErrorResponse{}),
+			},
+		},
 	}
 }
 
@@ -220,38 +678,279 @@ func (r *Route) CommonRoutes() []okapi.RouteDefinition {
 
 func (r *Route) AdminRoutes() []okapi.RouteDefinition {
 	apiGroup := &okapi.Group{Prefix: "/admin", Tags: []string{"AdminController"}}
-	// Apply JWT authentication middleware to the admin group
-	apiGroup.Use(middlewares.AdminJWTAuth.Middleware)
+	// Apply API key or JWT authentication middleware to the admin group, rejecting tokens of logins without two-factor
+	// authentication unless disabled, each route requires a permission granted to the API key or, by the RBAC policy,
+	// to the role of the user
+	apiGroup.Use(middlewares.AdminAPIKeyAuth.Or(middlewares.Revocable(middlewares.AdminJWTAuth, r.denylist)))
+	apiGroup.Use(r.rateLimit("admin")...)
 	apiGroup.Use(middlewares.CustomMiddleware)
 	apiGroup.WithBearerAuth() //Enable Bearer token for OpenAPI documentation
+	// Users change only the books they created, unless granted the books:any permission
+	ownBook := middlewares.RequireBookOwner(r.bookRepository)
 
 	return []okapi.RouteDefinition{
 
 		{
 			Method:  http.MethodPost,
 			Path:    "/books",
-			Handler: bookController.CreateBook,
+			Handler: middlewares.RequirePermission(rbac.BooksWrite)(r.bookController.CreateBook),
 			Group:   apiGroup,
 			Options: []okapi.RouteOption{
 				okapi.DocSummary("Create Book"),
-				okapi.DocDescription("Create a new book"),
+				okapi.DocDescription(requires("Create a new book owned by the current user", rbac.BooksWrite)),
 				okapi.DocRequestBody(models.Book{}),
 				okapi.DocResponse(models.Response{}),
+				etagHeader,
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
 			},
-			Security: bearerAuthSecurity,
+			Security: bearerOrAPIKeySecurity,
 		},
 
+		{
+			Method:   http.MethodGet,
+			Path:     "/books",
+			Handler:  middlewares.RequirePermission(rbac.BooksRead)(r.bookController.GetBooks),
+			Group:    apiGroup,
+			Options:  append(bookListDocs(requires("Get books", rbac.BooksRead)), okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{})),
+			Security: bearerOrAPIKeySecurity,
+		},
+		{
+			Method:  http.MethodPut,
+			Path:    "/books/:id",
+			Handler: middlewares.RequirePermission(rbac.BooksWrite)(ownBook(r.bookController.UpdateBook)),
+			Group:   apiGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Update Book"),
+				okapi.DocDescription(requires("Replace an existing book. "+ownershipNote, rbac.BooksWrite)),
+				okapi.DocPathParam("id", "int", "The ID of the book"),
+				okapi.DocRequestBody(models.Book{}),
+				okapi.DocResponse(models.Response{}),
+				etagHeader,
+				ifMatchHeader,
+				okapi.DocResponse(http.StatusConflict, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusPreconditionFailed, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusBadRequest, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusNotFound, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
+			},
+			Security: bearerOrAPIKeySecurity,
+		},
+		{
+			Method:  http.MethodPatch,
+			Path:    "/books/:id",
+			Handler: middlewares.RequirePermission(rbac.BooksWrite)(ownBook(r.bookController.PatchBook)),
+			Group:   apiGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Patch Book"),
+				okapi.DocDescription(requires("Partially update a book. Send a JSON Merge Patch (RFC 7396) with `application/merge-patch+json`, "+
+					"or a JSON Patch (RFC 6902) with `application/json-patch+json`. "+ownershipNote, rbac.BooksWrite)),
+				okapi.DocPathParam("id", "int", "The ID of the book"),
+				okapi.DocRequestBody(models.Book{}),
+				okapi.DocResponse(models.Response{}),
+				etagHeader,
+				ifMatchHeader,
+				okapi.DocResponse(http.StatusConflict, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusPreconditionFailed, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusBadRequest, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusNotFound, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
+			},
+			Security: bearerOrAPIKeySecurity,
+		},
+		{
+			Method:  http.MethodDelete,
+			Path:    "/books/:id",
+			Handler: middlewares.RequirePermission(rbac.BooksDelete)(ownBook(r.bookController.DeleteBook)),
+			Group:   apiGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Delete Book"),
+				okapi.DocDescription(requires("Delete a book. "+ownershipNote, rbac.BooksDelete)),
+				okapi.DocPathParam("id", "int", "The ID of the book"),
+				okapi.DocResponse(models.Response{}),
+				ifMatchHeader,
+				okapi.DocResponse(http.StatusConflict, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusPreconditionFailed, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusBadRequest, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusNotFound, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
+			},
+			Security: bearerOrAPIKeySecurity,
+		},
 		{
 			Method:  http.MethodGet,
-			Path:    "/books",
-			Handler: bookController.GetBooks,
+			Path:    "/users",
+			Handler: middlewares.RequirePermission(rbac.UsersAdmin)(r.authController.ListUsers),
 			Group:   apiGroup,
 			Options: []okapi.RouteOption{
-				okapi.DocSummary("Get Books"),
-				okapi.DocDescription("Get books"),
-				okapi.DocResponse([]models.Book{}),
+				okapi.DocSummary("List Users"),
+				okapi.DocDescription(requires("List all user accounts", rbac.UsersAdmin)),
+				okapi.DocResponse([]models.UserInfo{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
 			},
-			Security: bearerAuthSecurity,
+			Security: bearerOrAPIKeySecurity,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/users/:username/disable",
+			Handler: middlewares.RequirePermission(rbac.UsersAdmin)(r.authController.DisableUser),
+			Group:   apiGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Disable User"),
+				okapi.DocDescription(requires("Prevent a user from logging in", rbac.UsersAdmin)),
+				okapi.DocPathParam("username", "string", "The username"),
+				okapi.DocResponse(models.UserInfo{}),
+				okapi.DocResponse(http.StatusNotFound, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
+			},
+			Security: bearerOrAPIKeySecurity,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/users/:username/verify-email",
+			Handler: middlewares.RequirePermission(rbac.UsersAdmin)(r.authController.VerifyEmail),
+			Group:   apiGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Verify User Email"),
+				okapi.DocDescription(requires("Mark the email of a user as verified, the /core and /admin routes reject tokens of unverified users", rbac.UsersAdmin)),
+				okapi.DocPathParam("username", "string", "The username"),
+				okapi.DocResponse(models.UserInfo{}),
+				okapi.DocResponse(http.StatusNotFound, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
+			},
+			Security: bearerOrAPIKeySecurity,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/users/:username/enable",
+			Handler: middlewares.RequirePermission(rbac.UsersAdmin)(r.authController.EnableUser),
+			Group:   apiGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Enable User"),
+				okapi.DocDescription(requires("Allow a disabled user to log in again", rbac.UsersAdmin)),
+				okapi.DocPathParam("username", "string", "The username"),
+				okapi.DocResponse(models.UserInfo{}),
+				okapi.DocResponse(http.StatusNotFound, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
+			},
+			Security: bearerOrAPIKeySecurity,
+		},
+		{
+			Method:  http.MethodPut,
+			Path:    "/users/:username/role",
+			Handler: middlewares.RequirePermission(rbac.UsersAdmin)(r.authController.ChangeRole),
+			Group:   apiGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Change User Role"),
+				okapi.DocDescription(requires("Assign a role to a user, replacing their permissions with those of the role", rbac.UsersAdmin)),
+				okapi.DocPathParam("username", "string", "The username"),
+				okapi.DocRequestBody(models.ChangeRoleRequest{}),
+				okapi.DocResponse(models.UserInfo{}),
+				okapi.DocResponse(http.StatusBadRequest, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusNotFound, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
+			},
+			Security: bearerOrAPIKeySecurity,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/users/:username/mfa/reset",
+			Handler: middlewares.RequirePermission(rbac.UsersAdmin)(r.authController.ResetMFA),
+			Group:   apiGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Reset User MFA"),
+				okapi.DocDescription(requires("Turn off two-factor authentication of a user who lost their authenticator app and recovery codes", rbac.UsersAdmin)),
+				okapi.DocPathParam("username", "string", "The username"),
+				okapi.DocResponse(models.UserInfo{}),
+				okapi.DocResponse(http.StatusNotFound, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
+			},
+			Security: bearerOrAPIKeySecurity,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/tokens/revoke",
+			Handler: middlewares.RequirePermission(rbac.UsersAdmin)(r.authController.RevokeToken),
+			Group:   apiGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Revoke Token"),
+				okapi.DocDescription(requires("Revoke a JWT token by its ID (jti claim), it is rejected until it expires", rbac.UsersAdmin)),
+				okapi.DocRequestBody(models.RevokeTokenRequest{}),
+				okapi.DocResponse(models.AuthResponse{}),
+				okapi.DocResponse(http.StatusBadRequest, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
+			},
+			Security: bearerOrAPIKeySecurity,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/api-keys",
+			Handler: middlewares.RequirePermission(rbac.APIKeysAdmin)(r.apiKeyController.ListAPIKeys),
+			Group:   apiGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("List API Keys"),
+				okapi.DocDescription(requires("List the API keys of services, with when they were last used", rbac.APIKeysAdmin)),
+				okapi.DocResponse([]models.APIKeyInfo{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
+			},
+			Security: bearerOrAPIKeySecurity,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/api-keys",
+			Handler: middlewares.RequirePermission(rbac.APIKeysAdmin)(r.apiKeyController.CreateAPIKey),
+			Group:   apiGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Create API Key"),
+				okapi.DocDescription(requires("Create an API key for a service, granted some of the permissions of the current user. "+
+					"The key is only shown in this response", rbac.APIKeysAdmin)),
+				okapi.DocRequestBody(models.CreateAPIKeyRequest{}),
+				okapi.DocResponse(http.StatusCreated, models.CreatedAPIKey{}),
+				okapi.DocResponse(http.StatusBadRequest, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
+			},
+			Security: bearerOrAPIKeySecurity,
+		},
+		{
+			Method:  http.MethodDelete,
+			Path:    "/api-keys/:id",
+			Handler: middlewares.RequirePermission(rbac.APIKeysAdmin)(r.apiKeyController.RevokeAPIKey),
+			Group:   apiGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Revoke API Key"),
+				okapi.DocDescription(requires("Revoke an API key, it is rejected from now on", rbac.APIKeysAdmin)),
+				okapi.DocPathParam("id", "string", "The ID of the key"),
+				okapi.DocResponse(models.APIKeyInfo{}),
+				okapi.DocResponse(http.StatusNotFound, models.ErrorResponse{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
+			},
+			Security: bearerOrAPIKeySecurity,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/keys",
+			Handler: middlewares.RequirePermission(rbac.KeysAdmin)(r.authController.ListKeys),
+			Group:   apiGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("List Signing Keys"),
+				okapi.DocDescription(requires("List the active JWT signing key and the previous keys still verifying tokens", rbac.KeysAdmin)),
+				okapi.DocResponse([]models.KeyInfo{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
+			},
+			Security: bearerOrAPIKeySecurity,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/keys/rotate",
+			Handler: middlewares.RequirePermission(rbac.KeysAdmin)(r.authController.RotateKey),
+			Group:   apiGroup,
+			Options: []okapi.RouteOption{
+				okapi.DocSummary("Rotate Signing Key"),
+				okapi.DocDescription(requires("Sign new tokens with a freshly generated key of the same type. "+
+					"Tokens signed with the previous key stay valid until they expire. Generated keys are kept in memory only", rbac.KeysAdmin)),
+				okapi.DocResponse([]models.KeyInfo{}),
+				okapi.DocResponse(http.StatusForbidden, models.ErrorResponse{}),
+			},
+			Security: bearerOrAPIKeySecurity,
 		},
 	}
 }
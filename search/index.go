@@ -0,0 +1,199 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package search
+
+import (
+	"cmp"
+	"github.com/jkaninda/okapi-example/models"
+	"html"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Field weights, a match in the title ranks higher than a match in the author
+const (
+	titleWeight  = 2.0
+	authorWeight = 1.0
+)
+
+// Highlight markers wrapped around matched terms
+const (
+	highlightStart = "<mark>"
+	highlightEnd   = "</mark>"
+)
+
+// Hit is a book matching a search query
+type Hit struct {
+	Book  models.Book
+	Score float64
+	// Title and Author contain the field values with matched terms highlighted
+	Title  string
+	Author string
+}
+
+// posting records how often a term occurs in each field of a book
+type posting struct {
+	title  int
+	author int
+}
+
+// Index is an in-process inverted index over book titles and authors.
+// It is safe for concurrent use.
+type Index struct {
+	mu sync.RWMutex
+	// terms maps a folded term to the books containing it
+	terms map[string]map[int]posting
+	books map[int]models.Book
+}
+
+// NewIndex creates an empty index
+func NewIndex() *Index {
+	return &Index{
+		terms: make(map[string]map[int]posting),
+		books: make(map[int]models.Book),
+	}
+}
+
+// Add indexes a book, replacing any previous version of it
+func (idx *Index) Add(book models.Book) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(book.Id)
+	idx.books[book.Id] = book
+	for _, t := range Tokenize(book.Title) {
+		p := idx.posting(t.Term, book.Id)
+		p.title++
+		idx.terms[t.Term][book.Id] = p
+	}
+	for _, t := range Tokenize(book.Author) {
+		p := idx.posting(t.Term, book.Id)
+		p.author++
+		idx.terms[t.Term][book.Id] = p
+	}
+}
+
+// Remove drops a book from the index
+func (idx *Index) Remove(id int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(id)
+}
+
+// Len returns the number of indexed books
+func (idx *Index) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.books)
+}
+
+// Search returns the books matching any of the query terms, best matches first.
+// Scores use TF-IDF weighted by field, limit caps the number of hits when positive.
+func (idx *Index) Search(query string, limit int) ([]Hit, int) {
+	terms := make(map[string]bool)
+	for _, t := range Tokenize(query) {
+		terms[t.Term] = true
+	}
+	if len(terms) == 0 {
+		return []Hit{}, 0
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	scores := make(map[int]float64)
+	for term := range terms {
+		postings := idx.terms[term]
+		if len(postings) == 0 {
+			continue
+		}
+		idf := math.Log(1 + float64(len(idx.books))/float64(len(postings)))
+		for id, p := range postings {
+			scores[id] += idf * (titleWeight*float64(p.title) + authorWeight*float64(p.author))
+		}
+	}
+
+	hits := make([]Hit, 0, len(scores))
+	for id, score := range scores {
+		book := idx.books[id]
+		hits = append(hits, Hit{
+			Book:   book,
+			Score:  math.Round(score*1000) / 1000,
+			Title:  highlight(book.Title, terms),
+			Author: highlight(book.Author, terms),
+		})
+	}
+	slices.SortFunc(hits, func(a, b Hit) int {
+		if c := cmp.Compare(b.Score, a.Score); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Book.Id, b.Book.Id)
+	})
+	total := len(hits)
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, total
+}
+
+func (idx *Index) posting(term string, id int) posting {
+	if idx.terms[term] == nil {
+		idx.terms[term] = make(map[int]posting)
+	}
+	return idx.terms[term][id]
+}
+
+func (idx *Index) remove(id int) {
+	book, ok := idx.books[id]
+	if !ok {
+		return
+	}
+	for _, t := range append(Tokenize(book.Title), Tokenize(book.Author)...) {
+		delete(idx.terms[t.Term], id)
+		if len(idx.terms[t.Term]) == 0 {
+			delete(idx.terms, t.Term)
+		}
+	}
+	delete(idx.books, id)
+}
+
+// highlight wraps the terms of text found in terms with highlight markers.
+// The text is HTML escaped, so that the result can be rendered as HTML.
+func highlight(text string, terms map[string]bool) string {
+	var b strings.Builder
+	last := 0
+	for _, t := range Tokenize(text) {
+		if !terms[t.Term] {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[last:t.Start]))
+		b.WriteString(highlightStart)
+		b.WriteString(html.EscapeString(text[t.Start:t.End]))
+		b.WriteString(highlightEnd)
+		last = t.End
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return b.String()
+}
@@ -0,0 +1,183 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2025 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package search
+
+import (
+	"github.com/jkaninda/okapi-example/models"
+	"slices"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	got := Tokenize("Héllo, WÖRLD-42 Ça_va")
+	want := []Token{
+		{Term: "hello", Start: 0, End: 6},
+		{Term: "world", Start: 8, End: 14},
+		{Term: "42", Start: 15, End: 17},
+		{Term: "ca", Start: 18, End: 21},
+		{Term: "va", Start: 22, End: 24},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Tokenize() = %+v, want %+v", got, want)
+	}
+	if got := Tokenize(" -- !? "); len(got) != 0 {
+		t.Errorf("Tokenize() of separators = %+v, want none", got)
+	}
+}
+
+func TestFold(t *testing.T) {
+	for in, want := range map[string]string{
+		"Márquez":     "marquez",
+		"MARQUEZ":     "marquez",
+		"Ñandú":       "nandu",
+		"Dostoïevski": "dostoievski",
+		"":            "",
+	} {
+		if got := Fold(in); got != want {
+			t.Errorf("Fold(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func newTestIndex() *Index {
+	idx := NewIndex()
+	for _, book := range []models.Book{
+		{Id: 1, Title: "The Go Programming Language", Author: "Alan Donovan"},
+		{Id: 2, Title: "Go in Action", Author: "William Kennedy"},
+		{Id: 3, Title: "Concurrency in Practice", Author: "Go Team"},
+		{Id: 4, Title: "Cien años de soledad", Author: "Gabriel García Márquez"},
+	} {
+		idx.Add(book)
+	}
+	return idx
+}
+
+func hitIDs(hits []Hit) []int {
+	ids := make([]int, 0, len(hits))
+	for _, h := range hits {
+		ids = append(ids, h.Book.Id)
+	}
+	return ids
+}
+
+func TestSearchRanking(t *testing.T) {
+	idx := newTestIndex()
+	for _, tc := range []struct {
+		query string
+		want  []int
+	}{
+		// A title match outranks an author match, ties are ordered by id
+		{"go", []int{1, 2, 3}},
+		// Matching more terms ranks higher
+		{"go action", []int{2, 1, 3}},
+		{"GARCIA marquez", []int{4}},
+		{"años", []int{4}},
+		{"rust", []int{}},
+		{"  ", []int{}},
+	} {
+		hits, total := idx.Search(tc.query, 0)
+		if got := hitIDs(hits); !slices.Equal(got, tc.want) || total != len(tc.want) {
+			t.Errorf("Search(%q) = %v (total %d), want %v", tc.query, got, total, tc.want)
+		}
+	}
+
+	hits, total := idx.Search("go", 2)
+	if got := hitIDs(hits); !slices.Equal(got, []int{1, 2}) || total != 3 {
+		t.Errorf("Search() with limit = %v (total %d), want [1 2] (total 3)", got, total)
+	}
+	if title, author := hits[0].Score, scoreOf(t, idx, "go", 3); title <= author {
+		t.Errorf("title match score %v <= author match score %v", title, author)
+	}
+}
+
+func scoreOf(t *testing.T, idx *Index, query string, id int) float64 {
+	t.Helper()
+	hits, _ := idx.Search(query, 0)
+	for _, h := range hits {
+		if h.Book.Id == id {
+			return h.Score
+		}
+	}
+	t.Fatalf("Search(%q) does not find book %d", query, id)
+	return 0
+}
+
+func TestIndexAddRemove(t *testing.T) {
+	idx := newTestIndex()
+	if idx.Len() != 4 {
+		t.Fatalf("Len() = %d, want 4", idx.Len())
+	}
+
+	// Adding a book again replaces its terms
+	idx.Add(models.Book{Id: 2, Title: "Rust in Action", Author: "Tim McNamara"})
+	if hits, _ := idx.Search("kennedy", 0); len(hits) != 0 {
+		t.Errorf("the previous author of a replaced book still matches: %v", hitIDs(hits))
+	}
+	if hits, _ := idx.Search("rust", 0); !slices.Equal(hitIDs(hits), []int{2}) {
+		t.Errorf("Search(rust) = %v, want [2]", hitIDs(hits))
+	}
+	if idx.Len() != 4 {
+		t.Errorf("Len() after replace = %d, want 4", idx.Len())
+	}
+
+	idx.Remove(1)
+	idx.Remove(99)
+	if hits, _ := idx.Search("donovan go", 0); !slices.Equal(hitIDs(hits), []int{3}) {
+		t.Errorf("Search() after remove = %v, want [3]", hitIDs(hits))
+	}
+	if idx.Len() != 3 {
+		t.Errorf("Len() after remove = %d, want 3", idx.Len())
+	}
+}
+
+func TestSearchHighlight(t *testing.T) {
+	idx := NewIndex()
+	idx.Add(models.Book{Id: 1, Title: `<script>alert("Go")</script> & go`, Author: "Gabriel García Márquez"})
+
+	hits, _ := idx.Search("go garcia", 0)
+	if len(hits) != 1 {
+		t.Fatalf("Search() = %d hits, want 1", len(hits))
+	}
+	// The title is escaped, only the markers are HTML
+	wantTitle := `&lt;script&gt;alert(&#34;<mark>Go</mark>&#34;)&lt;/script&gt; &amp; <mark>go</mark>`
+	if hits[0].Title != wantTitle {
+		t.Errorf("Title = %q, want %q", hits[0].Title, wantTitle)
+	}
+	// The original spelling is kept around a folded match
+	if want := "Gabriel <mark>García</mark> Márquez"; hits[0].Author != want {
+		t.Errorf("Author = %q, want %q", hits[0].Author, want)
+	}
+
+	// A term that is part of a tag is marked inside the escaped text, never inside a tag
+	hits, _ = idx.Search("script", 0)
+	wantTitle = `&lt;<mark>script</mark>&gt;alert(&#34;Go&#34;)&lt;/<mark>script</mark>&gt; &amp; go`
+	if len(hits) != 1 || hits[0].Title != wantTitle {
+		t.Errorf("Search(script) = %+v, want title %q", hits, wantTitle)
+	}
+
+	if got := highlight("a < b", map[string]bool{}); got != "a &lt; b" {
+		t.Errorf("highlight() without matches = %q, want %q", got, "a &lt; b")
+	}
+}
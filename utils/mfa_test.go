@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 secret of the RFC 6238 test vectors, "12345678901234567890" in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// The last 6 digits of the 8 digit codes of RFC 6238 appendix B
+	for unix, want := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		got, err := TOTPCode(rfcSecret, TOTPStep(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("TOTPCode(T=%d) = %s, want %s", unix, got, want)
+		}
+	}
+	if _, err := TOTPCode("not base32!", 1); err == nil {
+		t.Error("TOTPCode() with an invalid secret succeeded")
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := TOTPStep(now)
+	code := func(step int64) string {
+		t.Helper()
+		c, err := TOTPCode(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	for _, tc := range []struct {
+		name     string
+		code     string
+		lastStep int64
+		step     int64
+		ok       bool
+	}{
+		{name: "current step", code: code(current), step: current, ok: true},
+		{name: "previous step", code: code(current - 1), step: current - 1, ok: true},
+		{name: "next step", code: code(current + 1), step: current + 1, ok: true},
+		{name: "two steps ago", code: code(current - 2)},
+		{name: "two steps ahead", code: code(current + 2)},
+		{name: "spaces are ignored", code: code(current)[:3] + " " + code(current)[3:], step: current, ok: true},
+		{name: "replayed step", code: code(current), lastStep: current},
+		{name: "step before the last one", code: code(current - 1), lastStep: current},
+		{name: "step after the last one", code: code(current), lastStep: current - 1, step: current, ok: true},
+		{name: "wrong code", code: strings.Repeat("0", TOTPDigits)},
+		{name: "too short", code: code(current)[:TOTPDigits-1]},
+		{name: "empty", code: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			step, ok := VerifyTOTP(rfcSecret, tc.code, now, tc.lastStep)
+			if ok != tc.ok || step != tc.step {
+				t.Errorf("VerifyTOTP(%q, lastStep %d) = %d, %t, want %d, %t", tc.code, tc.lastStep, step, ok, tc.step, tc.ok)
+			}
+		})
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("recovery code %q is not formatted as xxxxx-xxxxx", code)
+		}
+		if seen[code] {
+			t.Errorf("recovery code %q generated twice", code)
+		}
+		seen[code] = true
+	}
+	// Codes are typed by hand, case and surrounding spaces do not matter
+	if HashRecoveryCode(codes[0]) != HashRecoveryCode(" "+strings.ToUpper(codes[0])+" ") {
+		t.Error("HashRecoveryCode() depends on the case or spaces of the code")
+	}
+	if HashRecoveryCode(codes[0]) == HashRecoveryCode(codes[1]) {
+		t.Error("different recovery codes have the same hash")
+	}
+}
@@ -0,0 +1,26 @@
+package utils
+
+import "golang.org/x/crypto/bcrypt"
+
+// dummyPasswordHash is compared against when a user does not exist,
+// so that unknown and known usernames take the same time to reject
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("okapi-dummy-password"), bcrypt.DefaultCost)
+
+// HashPassword returns the bcrypt hash of password
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// VerifyPassword reports whether password matches the bcrypt hash.
+// An empty hash is checked against a dummy hash and always fails.
+func VerifyPassword(hash, password string) bool {
+	if hash == "" {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}